@@ -0,0 +1,160 @@
+package iap
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+)
+
+// subprotoMaxBatchFrames is the most data frames sent in a single write.
+const subprotoMaxBatchFrames = 4
+
+// writeBatch copies up to subprotoMaxBatchFrames frames of data from buf and sends
+// them with a single write, returning the number of bytes sent. The frames are built
+// as the data is copied, so it's only copied once. With WithReconnect the batch is
+// retained, so it is also limited to the send window.
+func (c *Conn) writeBatch(buf []byte) (int, error) {
+	n := min(len(buf), c.batchSize())
+
+	// wait for room before staging the batch, so an aborted Write can stop here
+	if c.sendUnacked != nil {
+		if err := c.waitSendWindow(n, c.sendAbortCh); err != nil {
+			return 0, err
+		}
+	}
+	if err := c.waitRateLimit(n); err != nil {
+		return 0, err
+	}
+
+	c.sendAbortMu.Lock()
+	if c.sendAborted {
+		c.sendAbortMu.Unlock()
+		return 0, os.ErrDeadlineExceeded
+	}
+	b := getBatch()
+	defer putBatch(b)
+	// retained data is kept without headers, so it's only framed once written
+	if c.sendUnacked != nil {
+		b.frames = append(b.frames[:0], buf[:n]...)
+	} else {
+		b.frames = appendDataFrames(b.frames[:0], buf[:n])
+	}
+	c.sendCopied += n
+	c.sendAbortMu.Unlock()
+
+	var err error
+	if c.sendUnacked != nil {
+		err = c.writeRetained(b.frames)
+	} else {
+		_, err = c.conn.Write(b.frames)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// batchSize returns the most data sent in a single write.
+func (c *Conn) batchSize() int {
+	size := subprotoMaxBatchFrames * subprotoMaxFrameSize
+	// rate limited data is reserved and sent a frame at a time, so a batch can't
+	// burst past the limiter
+	if c.sendLimiter != nil {
+		size = subprotoMaxFrameSize
+	}
+	if c.sendUnacked == nil {
+		return size
+	}
+
+	// retained data that doesn't fit in the window would never be sent
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return min(size, c.sendWindow)
+}
+
+// writeDataFrames sends bufs split into data frames with a single write, so they
+// share a WebSocket message. Conns that support vectored writes get the headers and
+// bodies as net.Buffers, others get the frames concatenated.
+func (c *Conn) writeDataFrames(conn net.Conn, bufs ...[]byte) error {
+	b := getBatch()
+	defer putBatch(b)
+
+	var nframes int
+	for _, buf := range bufs {
+		nframes += (len(buf) + subprotoMaxFrameSize - 1) / subprotoMaxFrameSize
+	}
+
+	switch conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		if cap(b.frames) < dataFrameHeaderSize*nframes {
+			b.frames = make([]byte, 0, dataFrameHeaderSize*nframes)
+		}
+		headers := b.frames[:dataFrameHeaderSize*nframes]
+		buffers := b.buffers[:0]
+
+		for _, buf := range bufs {
+			for len(buf) > 0 {
+				n := min(len(buf), subprotoMaxFrameSize)
+				header := headers[:dataFrameHeaderSize]
+				headers = headers[dataFrameHeaderSize:]
+				putDataFrameHeader(header, n)
+				buffers = append(buffers, header, buf[:n])
+				buf = buf[n:]
+			}
+		}
+
+		// WriteTo consumes buffers, so keep the slice it started with, and don't
+		// hold on to bufs once it's done
+		b.buffers = buffers
+		_, err := buffers.WriteTo(conn)
+		clear(b.buffers)
+		return err
+	default:
+		b.frames = appendDataFrames(b.frames[:0], bufs...)
+		_, err := conn.Write(b.frames)
+		return err
+	}
+}
+
+// appendDataFrames appends bufs split into data frames to dst.
+func appendDataFrames(dst []byte, bufs ...[]byte) []byte {
+	for _, buf := range bufs {
+		for len(buf) > 0 {
+			n := min(len(buf), subprotoMaxFrameSize)
+			dst = binary.BigEndian.AppendUint16(dst, subprotoTagData)
+			dst = binary.BigEndian.AppendUint32(dst, uint32(n))
+			dst = append(dst, buf[:n]...)
+			buf = buf[n:]
+		}
+	}
+	return dst
+}
+
+// batchFramesSize is the size of a full batch of data frames, headers included.
+const batchFramesSize = subprotoMaxBatchFrames * (dataFrameHeaderSize + subprotoMaxFrameSize)
+
+// batch holds the buffers a write of several frames is built in. They're only
+// needed while writing, so they're shared between connections.
+type batch struct {
+	frames  []byte
+	buffers net.Buffers
+}
+
+var batchPool = sync.Pool{
+	New: func() any {
+		return &batch{frames: make([]byte, 0, batchFramesSize)}
+	},
+}
+
+func getBatch() *batch {
+	return batchPool.Get().(*batch)
+}
+
+// putBatch returns b to the pool, unless it grew for an unusually large write.
+func putBatch(b *batch) {
+	if cap(b.frames) > batchFramesSize {
+		return
+	}
+	batchPool.Put(b)
+}
@@ -0,0 +1,150 @@
+package iap
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+)
+
+// Direction is the direction of captured bytes.
+type Direction byte
+
+const (
+	// DirectionReceived marks bytes received from the relay.
+	DirectionReceived Direction = '<'
+	// DirectionSent marks bytes sent to the relay.
+	DirectionSent Direction = '>'
+)
+
+// maxCaptureRecordSize is the most bytes in a capture record. Larger reads and writes
+// are split over several records, so ReplayFrames never has to trust a capture
+// asking for more.
+const maxCaptureRecordSize = 1 << 20
+
+// frameCapture records bytes exchanged with the relay. Each record is a direction
+// byte, a big-endian uint32 length and the bytes.
+type frameCapture struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (f *frameCapture) record(dir Direction, buf []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for len(buf) > 0 {
+		n := min(len(buf), maxCaptureRecordSize)
+		header := [5]byte{byte(dir)}
+		binary.BigEndian.PutUint32(header[1:], uint32(n))
+
+		// capturing is best effort and mustn't break the connection
+		f.w.Write(header[:])
+		f.w.Write(buf[:n])
+		buf = buf[n:]
+	}
+}
+
+// captureConn tees bytes read from and written to the relay into a capture.
+type captureConn struct {
+	net.Conn
+	capture *frameCapture
+}
+
+func (c *captureConn) Read(buf []byte) (int, error) {
+	n, err := c.Conn.Read(buf)
+	if n > 0 {
+		c.capture.record(DirectionReceived, buf[:n])
+	}
+	return n, err
+}
+
+func (c *captureConn) Write(buf []byte) (int, error) {
+	n, err := c.Conn.Write(buf)
+	if n > 0 {
+		c.capture.record(DirectionSent, buf[:n])
+	}
+	return n, err
+}
+
+// wrapConn wraps a connection to the relay in a captureConn if WithFrameCapture is
+// set, and a transcriptConn if WithTranscript is.
+func (c *Conn) wrapConn(netConn net.Conn) net.Conn {
+	if c.dopts.Transcript != nil {
+		netConn = &transcriptConn{Conn: netConn, transcript: c.dopts.Transcript}
+	}
+	if c.capture != nil {
+		netConn = &captureConn{netConn, c.capture}
+	}
+	return netConn
+}
+
+// unwrapConn returns the connection to the relay wrapped by wrapConn.
+func unwrapConn(netConn net.Conn) net.Conn {
+	if capture, ok := netConn.(*captureConn); ok {
+		netConn = capture.Conn
+	}
+	if transcript, ok := netConn.(*transcriptConn); ok {
+		netConn = transcript.Conn
+	}
+	return netConn
+}
+
+// ReplayFrames parses a capture written by WithFrameCapture and calls handler with
+// every frame in the order it was completed. It stops at the first error from the
+// capture, the parser, or handler. Bytes left over at the end of the capture that
+// don't make up a whole frame cause io.ErrUnexpectedEOF, and a record longer than
+// any WithFrameCapture writes causes a ProtocolError.
+func ReplayFrames(r io.Reader, handler func(Direction, Frame) error) error {
+	pending := map[Direction][]byte{}
+
+	for {
+		header := [5]byte{}
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		dir := Direction(header[0])
+		if dir != DirectionReceived && dir != DirectionSent {
+			return &ProtocolError{Err: "unknown capture direction"}
+		}
+
+		// the length is checked before allocating, since a corrupt capture can
+		// claim up to 4 GiB
+		size := binary.BigEndian.Uint32(header[1:])
+		if size > maxCaptureRecordSize {
+			return &ProtocolError{Err: "capture record too large"}
+		}
+
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+		buf = append(pending[dir], buf...)
+
+		for {
+			frame, n, err := parseFrame(buf)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				break
+			}
+			if err := handler(dir, frame); err != nil {
+				return err
+			}
+			buf = buf[n:]
+		}
+		pending[dir] = buf
+	}
+
+	for _, buf := range pending {
+		if len(buf) > 0 {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	return nil
+}
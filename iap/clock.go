@@ -0,0 +1,58 @@
+package iap
+
+import "time"
+
+// clock is the source of time for the timers of a Conn, a Listener and a
+// MeteredConn, replaced in tests with one that only moves when told to. Read and
+// write deadlines and Ping latencies always use the real time, since callers measure
+// them against it too, as do transcript timestamps, which aren't tied to a Conn.
+type clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) clockTimer
+	NewTicker(d time.Duration) clockTicker
+	AfterFunc(d time.Duration, f func()) clockTimer
+}
+
+// clockTimer is a time.Timer from a clock. Timers from AfterFunc have no channel.
+type clockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// clockTicker is a time.Ticker from a clock.
+type clockTicker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the clock of the time package, used unless withClock is set.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) clockTimer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) clockTicker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct{ *time.Timer }
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+type realTicker struct{ *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
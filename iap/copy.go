@@ -0,0 +1,65 @@
+package iap
+
+import (
+	"io"
+)
+
+var (
+	_ io.ReaderFrom = (*Conn)(nil)
+	_ io.WriterTo   = (*Conn)(nil)
+)
+
+// copyBufferSize is the size of the buffer used by ReadFrom, large enough for
+// Write to send a full batch of frames at once.
+const copyBufferSize = subprotoMaxBatchFrames * subprotoMaxFrameSize
+
+// ReadFrom reads data from r until EOF and writes it to the connection. It is used
+// by io.Copy, and sends data in larger batches than io.Copy's own buffer allows.
+// Writes block on flow control and fail once the write deadline passes as with Write.
+func (c *Conn) ReadFrom(r io.Reader) (n int64, err error) {
+	buf := make([]byte, copyBufferSize)
+
+	for {
+		nr, rerr := r.Read(buf)
+		if nr > 0 {
+			nw, werr := c.Write(buf[:nr])
+			n += int64(nw)
+			if werr != nil {
+				return n, werr
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// WriteTo writes data read from the connection to w until the relay closes the
+// connection. It is used by io.Copy, and reads a frame at a time. Reads fail once the
+// read deadline passes as with Read.
+func (c *Conn) WriteTo(w io.Writer) (n int64, err error) {
+	buf := make([]byte, subprotoMaxFrameSize)
+
+	for {
+		nr, rerr := c.Read(buf)
+		if nr > 0 {
+			nw, werr := w.Write(buf[:nr])
+			n += int64(nw)
+			if werr == nil && nw < nr {
+				werr = io.ErrShortWrite
+			}
+			if werr != nil {
+				return n, werr
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
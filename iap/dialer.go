@@ -0,0 +1,56 @@
+package iap
+
+import (
+	"context"
+	"net/http"
+
+	"golang.org/x/oauth2"
+)
+
+// Dialer dials connections with a shared set of options. It caches tokens from
+// the token source and reuses one HTTP client across dials, so it should be
+// preferred over calling Dial repeatedly with the same options.
+type Dialer struct {
+	opts   []DialOption
+	dopts  *dialOptions
+	client *http.Client
+}
+
+// NewDialer returns a Dialer that dials with opts.
+func NewDialer(opts ...DialOption) *Dialer {
+	opts = opts[:len(opts):len(opts)]
+
+	dopts := &dialOptions{}
+	dopts.collectOpts(opts)
+
+	if dopts.TokenSource != nil {
+		tokenSource := oauth2.ReuseTokenSource(nil, *dopts.TokenSource)
+		opts = append(opts, WithTokenSource(&tokenSource))
+	}
+
+	return &Dialer{
+		opts:   opts,
+		dopts:  dopts,
+		client: httpClient(dopts),
+	}
+}
+
+// Dial connects to the destination with the Dialer's options, overridden by opts.
+func (d *Dialer) Dial(ctx context.Context, opts ...DialOption) (*Conn, error) {
+	return Dial(ctx, d.merge(opts)...)
+}
+
+// merge returns the Dialer's options followed by opts, sharing the Dialer's HTTP
+// client unless opts change how the relay is reached.
+func (d *Dialer) merge(opts []DialOption) []DialOption {
+	merged := append(d.opts[:len(d.opts):len(d.opts)], opts...)
+
+	dopts := &dialOptions{}
+	dopts.collectOpts(merged)
+
+	if d.client != nil && d.dopts.sameTransport(dopts) {
+		merged = append(merged, withHTTPClient(d.client))
+	}
+
+	return merged
+}
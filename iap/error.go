@@ -1,7 +1,48 @@
 package iap
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
+var (
+	// ErrIdleTimeout is reported when a connection is closed by WithIdleTimeout.
+	ErrIdleTimeout = errors.New("idle timeout")
+	// ErrKeepAliveTimeout is reported when a connection is closed by WithKeepAlive.
+	ErrKeepAliveTimeout = errors.New("keepalive timeout")
+	// ErrSessionExpired is returned by Dial with WithResumeCheckpoint when the relay
+	// rejects the session, usually because it expired. It wraps the relay's error.
+	ErrSessionExpired = errors.New("session expired")
+
+	// ErrUnauthorized is returned by Probe when the relay refuses the credentials.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrNotFound is returned by Probe when the destination doesn't exist.
+	ErrNotFound = errors.New("not found")
+	// ErrUnreachable is returned by Probe when the relay or destination can't be reached.
+	ErrUnreachable = errors.New("unreachable")
+
+	// ErrNoSuccessFrame is wrapped in a ProtocolError when the relay sends another frame
+	// before the success frame, which usually means a relay or authorization problem.
+	ErrNoSuccessFrame = errors.New("expected success frame but did not receive one")
+	// ErrDuplicateSuccessFrame is wrapped in a ProtocolError when the relay sends a success
+	// frame on a connection that is already established.
+	ErrDuplicateSuccessFrame = errors.New("received success frame on established connection")
+	// ErrNonBinaryMessage is wrapped in a ProtocolError when the relay sends a WebSocket
+	// message that isn't binary, such as a text message, which can't hold frames.
+	ErrNonBinaryMessage = errors.New("relay sent a non-binary message")
+	// ErrMessageTooLarge is wrapped in a ProtocolError when the relay sends a WebSocket
+	// message larger than the read limit set by WithReadLimit.
+	ErrMessageTooLarge = errors.New("relay sent a message over the read limit")
+	// ErrFrameTooLarge is wrapped in a ProtocolError when the relay sends a frame longer
+	// than the max frame size, which means a relay bug or that the stream is out of sync.
+	ErrFrameTooLarge = errors.New("frame too large")
+	// ErrAckRegression is wrapped in a ProtocolError when the relay acks fewer bytes
+	// than it already has, see WithAckRegressionMode.
+	ErrAckRegression = errors.New("ack regressed")
+)
+
+// CloseError is returned when the relay closes the WebSocket with an error code,
+// which is how it reports errors such as the destination being unreachable.
 type CloseError struct {
 	Code   int
 	Reason string
@@ -13,8 +54,66 @@ func (e *CloseError) Error() string {
 
 type ProtocolError struct {
 	Err string
+
+	// err is the sentinel error this wraps, if any
+	err error
+}
+
+func newProtocolError(err error) *ProtocolError {
+	return &ProtocolError{Err: err.Error(), err: err}
+}
+
+// newUnknownTagError returns a ProtocolError for a frame with an unknown tag. Its
+// length isn't known, so the rest of the stream can't be parsed.
+func newUnknownTagError(tag uint16) *ProtocolError {
+	return &ProtocolError{Err: fmt.Sprintf("unknown frame tag %#x", tag)}
+}
+
+// newFrameTooLargeError returns a ProtocolError wrapping ErrFrameTooLarge with the
+// length of the frame, the max it exceeded and how many bytes of data were received
+// before it, for bug reports.
+func newFrameTooLargeError(len, max uint32, offset uint64) *ProtocolError {
+	return &ProtocolError{
+		Err: fmt.Sprintf("%v: length %d exceeds max %d at data offset %d", ErrFrameTooLarge, len, max, offset),
+		err: ErrFrameTooLarge,
+	}
+}
+
+// newAckRegressionError returns a ProtocolError wrapping ErrAckRegression with the
+// ack received and the one before it.
+func newAckRegressionError(nb, acked uint64) *ProtocolError {
+	return &ProtocolError{
+		Err: fmt.Sprintf("%v: relay acked %d bytes after acking %d", ErrAckRegression, nb, acked),
+		err: ErrAckRegression,
+	}
 }
 
 func (e *ProtocolError) Error() string {
 	return fmt.Sprintf("protocol error: %v", e.Err)
 }
+
+func (e *ProtocolError) Unwrap() error {
+	return e.err
+}
+
+type ConfigError struct {
+	Err string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid configuration: %v", e.Err)
+}
+
+// HandshakeError is returned when the relay rejects the WebSocket handshake.
+type HandshakeError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("handshake failed: status %v: %v", e.StatusCode, e.Err)
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,204 @@
+package iap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+)
+
+// Frame tags of the relay subprotocol.
+const (
+	FrameTagSuccess      = subprotoTagSuccess
+	FrameTagReconnectAck = subprotoTagReconnectAck
+	FrameTagData         = subprotoTagData
+	FrameTagAck          = subprotoTagAck
+)
+
+// Sizes of the relay subprotocol, which are fixed by the relay. MaxFrameSize is the
+// largest payload of a data frame, so buffers of that size hold any frame. The relay
+// stops sending once AckThreshold bytes it sent are unacked.
+const (
+	MaxFrameSize = subprotoMaxFrameSize
+	AckThreshold = subprotoAckThreshold
+)
+
+// Frame is a decoded subprotocol frame.
+type Frame struct {
+	Tag uint16
+	// Payload is the session ID of a success frame, the data of a data frame,
+	// or the big-endian byte count of an ack or reconnect ack frame.
+	Payload []byte
+}
+
+func makeSuccessFrame(sessionID string) []byte {
+	if int64(len(sessionID)+6) > int64(math.MaxUint32) {
+		panic("data too large for frame")
+	}
+	buf := make([]byte, len(sessionID)+6)
+	binary.BigEndian.PutUint16(buf[0:2], subprotoTagSuccess)
+	binary.BigEndian.PutUint32(buf[2:6], uint32(len(sessionID)))
+	copy(buf[6:], []byte(sessionID))
+	return buf
+}
+
+func makeAckFrame(nb uint64) []byte {
+	buf := make([]byte, 10)
+	binary.BigEndian.PutUint16(buf[0:2], subprotoTagAck)
+	binary.BigEndian.PutUint64(buf[2:10], nb)
+	return buf
+}
+
+func makeReconnectAckFrame(nb uint64) []byte {
+	buf := make([]byte, 10)
+	binary.BigEndian.PutUint16(buf[0:2], subprotoTagReconnectAck)
+	binary.BigEndian.PutUint64(buf[2:10], nb)
+	return buf
+}
+
+func makeDataFrame(data []byte) []byte {
+	if int64(len(data)+6) > int64(math.MaxUint32) {
+		panic("data too large for frame")
+	}
+	buf := make([]byte, 6, 6+len(data))
+	putDataFrameHeader(buf, len(data))
+	return append(buf, data...)
+}
+
+func putDataFrameHeader(header []byte, n int) {
+	binary.BigEndian.PutUint16(header[0:2], subprotoTagData)
+	binary.BigEndian.PutUint32(header[2:6], uint32(n))
+}
+
+// decodeFrame reads a whole frame from r, see readFrameBody. It returns io.EOF if r
+// ends before the frame starts.
+func decodeFrame(r io.Reader, maxLen uint32) (Frame, error) {
+	bytes := [2]byte{}
+	if _, err := io.ReadFull(r, bytes[:]); err != nil {
+		return Frame{}, err
+	}
+
+	return readFrameBody(r, binary.BigEndian.Uint16(bytes[:]), maxLen, 0)
+}
+
+// readFrameBody reads the rest of a frame from r once its tag has been read. Success
+// and data frames longer than maxLen fail with ErrFrameTooLarge, which reports
+// received as the number of data bytes received before the frame. Data frames are
+// usually streamed to readers instead, so this is for everything else.
+func readFrameBody(r io.Reader, tag uint16, maxLen uint32, received uint64) (Frame, error) {
+	var len uint32
+
+	switch tag {
+	case subprotoTagSuccess, subprotoTagData:
+		bytes := [4]byte{}
+		if _, err := io.ReadFull(r, bytes[:]); err != nil {
+			return Frame{}, unexpectedEOF(err)
+		}
+		len = binary.BigEndian.Uint32(bytes[:])
+
+		if len > maxLen {
+			return Frame{}, newFrameTooLargeError(len, maxLen, received)
+		}
+		if tag == subprotoTagSuccess && len == 0 {
+			return Frame{}, &ProtocolError{Err: "success frame has empty session ID"}
+		}
+	case subprotoTagReconnectAck, subprotoTagAck:
+		len = 8
+	default:
+		return Frame{}, newUnknownTagError(tag)
+	}
+
+	payload := make([]byte, len)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return Frame{}, unexpectedEOF(err)
+	}
+
+	return Frame{tag, payload}, nil
+}
+
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF for a frame cut off partway.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// parseFrame decodes the frame at the start of buf, returning the number of bytes
+// it used. It returns 0 and no error if buf doesn't hold a whole frame yet.
+func parseFrame(buf []byte) (Frame, int, error) {
+	r := bytes.NewReader(buf)
+
+	frame, err := decodeFrame(r, subprotoMaxFrameSize)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return Frame{}, 0, nil
+	}
+	if err != nil {
+		return Frame{}, 0, err
+	}
+
+	return frame, len(buf) - r.Len(), nil
+}
+
+var errRawFrames = &ConfigError{"Read and Peek can't be used with WithRawFrames, use NextFrame"}
+
+// NextFrame returns the next frame received from the relay, including frames the
+// Conn has already acted on such as acks. It requires WithRawFrames.
+func (c *Conn) NextFrame(ctx context.Context) (Frame, error) {
+	if c.rawFrames == nil {
+		return Frame{}, &ConfigError{"NextFrame requires WithRawFrames"}
+	}
+
+	select {
+	case frame := <-c.rawFrames:
+		return frame, nil
+	case <-c.readDone:
+		return Frame{}, c.Err()
+	case <-ctx.Done():
+		return Frame{}, ctx.Err()
+	}
+}
+
+// readRawFrame reads the rest of a frame with the given tag and hands it to
+// NextFrame. The frame still updates the state of the connection, but received
+// data isn't acked.
+func (c *Conn) readRawFrame(tag uint16) error {
+	if tag != subprotoTagSuccess && !c.connected {
+		return newProtocolError(ErrNoSuccessFrame)
+	}
+
+	c.ackMu.Lock()
+	received := c.recvNbUnacked
+	c.ackMu.Unlock()
+
+	frame, err := readFrameBody(c.conn, tag, c.recvMaxFrame, received)
+	if err != nil {
+		return err
+	}
+	payload := frame.Payload
+
+	switch tag {
+	case subprotoTagSuccess:
+		// the caller owns the payload
+		c.setSessionID(append([]byte(nil), payload...))
+	case subprotoTagReconnectAck, subprotoTagAck:
+		if err := c.ackSent(binary.BigEndian.Uint64(payload), tag == subprotoTagReconnectAck); err != nil {
+			return err
+		}
+	case subprotoTagData:
+		c.ackMu.Lock()
+		c.recvNbUnacked += uint64(len(payload))
+		c.ackMu.Unlock()
+		c.recvRate.add(len(payload), c.clock.Now())
+		c.touch()
+	}
+
+	select {
+	case c.rawFrames <- frame:
+		return nil
+	case <-c.ctx.Done():
+		return net.ErrClosed
+	}
+}
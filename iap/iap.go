@@ -2,16 +2,20 @@
 package iap
 
 import (
+	"bufio"
 	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"math"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coder/websocket"
@@ -25,70 +29,171 @@ var proxyOrigin = "bot:iap-tunneler"
 const (
 	proxySubproto = "relay.tunnel.cloudproxy.app"
 	proxyHost     = "tunnel.cloudproxy.app"
-	proxyPath     = "/v4/connect"
+
+	defaultProtocolVersion = 4
+
+	// defaultReadLimit leaves room for a relay that batches frames like Conn does
+	defaultReadLimit = 16 * subprotoMaxFrameSize
 )
 
+// supportedProtocolVersions are the versions of the relay API whose framing this
+// package implements.
+var supportedProtocolVersions = []int{4}
+
+// connectPath returns the path of the relay's endpoint for new connections.
+func connectPath(version int) string {
+	return fmt.Sprintf("/v%d/connect", version)
+}
+
+// reconnectPath returns the path of the relay's endpoint for resuming sessions.
+func reconnectPath(version int) string {
+	return fmt.Sprintf("/v%d/reconnect", version)
+}
+
+// The subprotocol has no frame for errors. The relay reports them by closing the
+// WebSocket with a code, which surfaces as a CloseError, so any other tag is a
+// ProtocolError.
 const (
-	subprotoMaxFrameSize        = 16384
-	subprotoAckThreshold        = 2 * subprotoMaxFrameSize
-	subprotoTagSuccess   uint16 = 0x1
-	subprotoTagData      uint16 = 0x4
-	subprotoTagAck       uint16 = 0x7
+	subprotoMaxFrameSize           = 16384
+	subprotoAckThreshold           = 2 * subprotoMaxFrameSize
+	subprotoSendWindow             = 64 * subprotoMaxFrameSize
+	subprotoTagSuccess      uint16 = 0x1
+	subprotoTagReconnectAck uint16 = 0x2
+	subprotoTagData         uint16 = 0x4
+	subprotoTagAck          uint16 = 0x7
 )
 
-// copyNBuffer is like io.CopyN but stages through a given buffer like io.CopyBuffer.
-func copyNBuffer(w io.Writer, r io.Reader, n int64, buf []byte) (int64, error) {
-	return io.CopyBuffer(w, io.LimitReader(r, n), buf)
+// dataFrameHeaderSize is the size of the tag and length before the data of a frame.
+const dataFrameHeaderSize = 6
+
+// framePool holds buffers for a whole data frame, header included, shared between
+// connections.
+var framePool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, dataFrameHeaderSize+subprotoMaxFrameSize)
+		return &buf
+	},
 }
 
-func makeSuccessFrame(sessionID string) []byte {
-	if int64(len(sessionID)+6) > int64(math.MaxUint32) {
-		panic("data too large for frame")
-	}
-	buf := make([]byte, len(sessionID)+6)
-	binary.BigEndian.PutUint16(buf[0:2], subprotoTagSuccess)
-	binary.BigEndian.PutUint32(buf[2:6], uint32(len(sessionID)))
-	copy(buf[6:], []byte(sessionID))
-	return buf
+func getFrameBuf() []byte {
+	return *framePool.Get().(*[]byte)
 }
 
-func makeAckFrame(nb uint64) []byte {
-	buf := make([]byte, 10)
-	binary.BigEndian.PutUint16(buf[0:2], subprotoTagAck)
-	binary.BigEndian.PutUint64(buf[2:10], nb)
-	return buf
+func putFrameBuf(buf []byte) {
+	framePool.Put(&buf)
 }
 
-func makeDataFrame(data []byte) []byte {
-	if int64(len(data)+6) > int64(math.MaxUint32) {
-		panic("data too large for frame")
-	}
-	buf := make([]byte, 6)
-	binary.BigEndian.PutUint16(buf[:], subprotoTagData)
-	binary.BigEndian.PutUint32(buf[2:6], uint32(len(data)))
-	return append(buf[:], data...)
+type sendResult struct {
+	n   int
+	err error
 }
 
 type Conn struct {
-	conn      net.Conn
-	connected bool
-	sessionID []byte
-
+	conn        net.Conn
+	connMu      sync.RWMutex
+	connected   bool
+	connectedCh chan struct{}
+	closed      atomic.Bool
+	closedOnce  sync.Once
+	closedCh    chan struct{}
+	sessionID   []byte
+
+	url           string
+	dopts         *dialOptions
+	clock         clock
+	remoteAddr    net.Addr
+	handshakeResp *http.Response
+	capture       *frameCapture
+
+	ackMu         sync.Mutex
+	manualAck     bool
+	ackDelay      time.Duration
+	ackTimer      clockTimer
 	recvNbAcked   uint64
 	recvNbUnacked uint64
-	recvBuf       []byte
-	recvReader    *io.PipeReader
-	recvWriter    *io.PipeWriter
-
+	recvMaxFrame  uint32
+	recvRate      rateMeter
+	recvPipe      *pipe
+	recvPeeker    *bufio.Reader
+	recvMu        sync.Mutex
+	rawFrames     chan Frame
+
+	sendMu      sync.Mutex
 	sendNbAcked uint64
-	sendNbCh    chan int
+	sendRate    rateMeter
+	sendLimiter *rateLimiter
+	sendUnacked *ringBuffer
+	sendWindow  int
+	sendAckCh   chan struct{}
+	sendCh      chan []byte
+	sendResCh   chan sendResult
+	sendClosed  atomic.Bool
+	writeMu     sync.Mutex
+	sendFrame   []byte
 	sendBuf     []byte
-	sendReader  *io.PipeReader
-	sendWriter  *io.PipeWriter
 
+	// a Write that times out leaves its result pending and stops the write
+	// loop from copying any more of its buffer, sendCopied being how much of
+	// it was copied
+	writeDeadline  *deadline
+	sendResPending bool
+	sendAbortMu    sync.Mutex
+	sendAborted    bool
+	sendCopied     int
+	sendAbortCh    chan struct{}
+
+	initialData       []byte
+	coalesceDelay     time.Duration
+	coalesceThreshold int
+	sendPending       int
+	flushTimer        <-chan time.Time
+	flushCh           chan chan error
+	writeDone         chan struct{}
+	readDone          chan struct{}
+
+	reconnects    atomic.Uint64
+	bytesReplayed atomic.Uint64
+
+	idleTimeout  time.Duration
+	lastActivity atomic.Int64
+
+	errMu sync.Mutex
+	err   error
+
+	wg            sync.WaitGroup
+	ctx           context.Context
+	cancel        context.CancelFunc
+	closeErr      error
 	closeOnceFunc func()
 }
 
+// addr is a net.Addr describing a tunnel destination.
+type addr string
+
+func (a addr) Network() string {
+	return "iap"
+}
+
+func (a addr) String() string {
+	return string(a)
+}
+
+// destinationAddr returns the address of the instance or host targeted, or nil if
+// there isn't one.
+func destinationAddr(dopts *dialOptions) net.Addr {
+	var host string
+	switch {
+	case dopts.Instance != "":
+		host = dopts.Instance
+	case dopts.Host != "":
+		host = dopts.Host
+	default:
+		return nil
+	}
+
+	return addr(net.JoinHostPort(host, dopts.Port))
+}
+
 func connectURL(dopts *dialOptions) string {
 	query := url.Values{
 		"zone":      []string{dopts.Zone},
@@ -101,6 +206,9 @@ func connectURL(dopts *dialOptions) string {
 		"host":      []string{dopts.Host},
 		"group":     []string{dopts.Group},
 	}
+	for key, value := range dopts.ConnectParams {
+		query.Set(key, value)
+	}
 
 	for key, value := range query {
 		if value[0] == "" {
@@ -111,7 +219,7 @@ func connectURL(dopts *dialOptions) string {
 	url := url.URL{
 		Scheme:   "wss",
 		Host:     proxyHost,
-		Path:     proxyPath,
+		Path:     connectPath(dopts.protocolVersion()),
 		RawQuery: query.Encode(),
 	}
 
@@ -123,116 +231,699 @@ func Dial(ctx context.Context, opts ...DialOption) (*Conn, error) {
 	dopts := &dialOptions{}
 	dopts.collectOpts(opts)
 
+	if err := dopts.validate(); err != nil {
+		return nil, err
+	}
+	if err := dopts.resolveLocation(ctx); err != nil {
+		return nil, err
+	}
+	opts = append(opts[:len(opts):len(opts)], withLocation(dopts.Zone, dopts.Region))
+
 	url := connectURL(dopts)
+	if len(dopts.RelayHosts) > 0 {
+		return dialRelayHosts(ctx, url, dopts.RelayHosts, opts)
+	}
 	return dial(ctx, url, opts...)
 }
 
+// dialRelayHosts dials connectURL on each of hosts in turn until one succeeds,
+// returning the errors from all of them if none do.
+func dialRelayHosts(ctx context.Context, connectURL string, hosts []string, opts []DialOption) (*Conn, error) {
+	u, err := url.Parse(connectURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, host := range hosts {
+		u.Host = host
+
+		conn, err := dial(ctx, u.String(), opts...)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, fmt.Errorf("%v: %w", host, err))
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, fmt.Errorf("failed to dial relay hosts: %w", errors.Join(errs...))
+}
+
 func dial(ctx context.Context, url string, opts ...DialOption) (*Conn, error) {
 	dopts := &dialOptions{}
 	dopts.collectOpts(opts)
 
+	if dopts.TranscriptWriter != nil {
+		dopts.Transcript = newTranscript(dopts.TranscriptWriter)
+		opts = append(opts[:len(opts):len(opts)], withTranscript(dopts.Transcript))
+	}
+
+	if dopts.Resume != nil {
+		return dialResume(ctx, url, dopts, opts)
+	}
+
+	netConn, resp, err := dialWebsocket(ctx, url, dopts)
+	if err != nil {
+		return nil, err
+	}
+
+	c := NewConn(netConn, append(opts[:len(opts):len(opts)], withURL(url), withHandshakeResponse(resp))...)
+
+	if dopts.WaitConnected > 0 {
+		waitCtx, cancel := context.WithTimeout(ctx, dopts.WaitConnected)
+		defer cancel()
+
+		if err := c.WaitConnected(waitCtx); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func websocketDialOptions(dopts *dialOptions) *websocket.DialOptions {
+	wsOptions := &websocket.DialOptions{
+		Subprotocols:    []string{proxySubproto},
+		CompressionMode: websocket.CompressionDisabled,
+		HTTPClient:      httpClient(dopts),
+		Host:            dopts.HostHeader,
+	}
+
+	switch dopts.CompressionMode {
+	case CompressionContextTakeover:
+		wsOptions.CompressionMode = websocket.CompressionContextTakeover
+	case CompressionNoContextTakeover:
+		wsOptions.CompressionMode = websocket.CompressionNoContextTakeover
+	}
+
+	return wsOptions
+}
+
+func dialWebsocket(ctx context.Context, url string, dopts *dialOptions) (net.Conn, *http.Response, error) {
 	header := make(http.Header)
 	header.Set("Origin", proxyOrigin)
 
 	if dopts.TokenSource != nil {
 		token, err := (*dopts.TokenSource).Token()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		header.Set("Authorization", fmt.Sprintf("%v %v", token.Type(), token.AccessToken))
 	}
 
-	wsOptions := websocket.DialOptions{
-		HTTPHeader:      header,
-		Subprotocols:    []string{proxySubproto},
-		CompressionMode: websocket.CompressionDisabled,
+	wsOptions := websocketDialOptions(dopts)
+	wsOptions.HTTPHeader = header
+
+	dialer := dopts.Dialer
+	if dialer == nil {
+		dialer = websocketNetConnDialer(dopts.readLimit())
 	}
-	if dopts.Compress {
-		wsOptions.CompressionMode = websocket.CompressionContextTakeover
+
+	dialCtx := ctx
+	if dopts.DialTrace != nil {
+		dialCtx = httptrace.WithClientTrace(ctx, dopts.DialTrace)
 	}
 
-	conn, _, err := websocket.Dial(ctx, url, &wsOptions)
+	conn, resp, err := dialer(dialCtx, url, wsOptions)
+	if err == nil && ctx.Err() != nil {
+		// the handshake finished as ctx was canceled, the conn is unusable
+		err = ctx.Err()
+	}
+	dopts.Transcript.dial(url, header, resp, err)
 	if err != nil {
-		return nil, err
+		if conn != nil {
+			conn.Close()
+		}
+		if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+			err = &HandshakeError{resp.StatusCode, err}
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+			err = fmt.Errorf("%w: %w", ctxErr, err)
+		}
+		return nil, nil, err
 	}
 
-	netConn := websocket.NetConn(ctx, conn, websocket.MessageBinary)
+	// the body belongs to the WebSocket connection, don't hand it out
+	resp = &http.Response{
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+		Proto:      resp.Proto,
+		ProtoMajor: resp.ProtoMajor,
+		ProtoMinor: resp.ProtoMinor,
+		Header:     resp.Header.Clone(),
+		Body:       http.NoBody,
+	}
 
-	return newConn(netConn), nil
+	return conn, resp, nil
 }
 
-func newConn(netConn net.Conn) *Conn {
-	recvReader, recvWriter := io.Pipe()
-	sendReader, sendWriter := io.Pipe()
+// websocketNetConnDialer returns a dialer for the relay that limits messages read
+// to readLimit bytes.
+func websocketNetConnDialer(readLimit int64) websocketDialer {
+	return func(ctx context.Context, url string, wsOptions *websocket.DialOptions) (net.Conn, *http.Response, error) {
+		conn, resp, err := websocket.Dial(ctx, url, wsOptions)
+		if err != nil {
+			return nil, resp, err
+		}
+
+		// NetConn disables the limit since it streams messages rather than
+		// buffering them, so it has to be set afterwards
+		netConn := websocket.NetConn(ctx, conn, websocket.MessageBinary)
+		conn.SetReadLimit(readLimit)
+
+		return &websocketConn{netConn, conn}, resp, nil
+	}
+}
+
+// websocketConn is a WebSocket NetConn that keeps the WebSocket to ping the relay.
+type websocketConn struct {
+	net.Conn
+	ws *websocket.Conn
+}
+
+func (c *websocketConn) Ping(ctx context.Context) error {
+	return c.ws.Ping(ctx)
+}
+
+// NewConn runs the IAP protocol over netConn, which must already be connected to a
+// relay or something speaking the relay's side of the protocol, such as one end of
+// a net.Pipe in tests. The caller is responsible for that, as nothing is dialed and
+// options that affect dialing have no effect. WithReconnect can't redial either, so
+// the Conn ends when netConn does. With WithResumeCheckpoint, netConn must be a
+// reconnection to the session, and the Conn starts out connected.
+func NewConn(netConn net.Conn, opts ...DialOption) *Conn {
+	dopts := &dialOptions{}
+	dopts.collectOpts(opts)
 
 	c := &Conn{
-		conn: netConn,
 
-		recvBuf:    make([]byte, subprotoMaxFrameSize),
-		recvReader: recvReader,
-		recvWriter: recvWriter,
+		connectedCh: make(chan struct{}),
+		closedCh:    make(chan struct{}),
+
+		url:           dopts.URL,
+		handshakeResp: dopts.HandshakeResp,
+		dopts:         dopts,
+		clock:         dopts.Clock,
+		remoteAddr:    destinationAddr(dopts),
 
-		sendNbCh:   make(chan int),
-		sendBuf:    make([]byte, subprotoMaxFrameSize),
-		sendReader: sendReader,
-		sendWriter: sendWriter,
+		recvPipe: newPipe(dopts.RecvBufferCap),
+
+		sendAckCh: make(chan struct{}, 1),
+		sendCh:    make(chan []byte),
+		sendResCh: make(chan sendResult, 1),
+
+		writeDeadline: newDeadline(),
+		sendAbortCh:   make(chan struct{}, 1),
+
+		initialData:   dopts.InitialData,
+		coalesceDelay: dopts.CoalesceDelay,
+		flushCh:       make(chan chan error),
+		writeDone:     make(chan struct{}),
+		readDone:      make(chan struct{}),
+
+		manualAck:   dopts.ManualAck,
+		ackDelay:    dopts.AckDelay,
+		idleTimeout: dopts.IdleTimeout,
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	if c.clock == nil {
+		c.clock = realClock{}
+	}
+	if dopts.TranscriptWriter != nil && dopts.Transcript == nil {
+		dopts.Transcript = newTranscript(dopts.TranscriptWriter)
+	}
+	if dopts.FrameCapture != nil {
+		c.capture = &frameCapture{w: dopts.FrameCapture}
+	}
+	c.conn = c.wrapConn(netConn)
+	if dopts.WriteBufferSize > 0 && dopts.WriteBufferSize != subprotoMaxFrameSize {
+		c.sendFrame = make([]byte, dataFrameHeaderSize+dopts.WriteBufferSize)
+	} else {
+		c.sendFrame = getFrameBuf()
+	}
+	// writes are staged after room for the header, which only needs its length
+	// filled in to send them as a frame
+	binary.BigEndian.PutUint16(c.sendFrame, subprotoTagData)
+	c.sendBuf = c.sendFrame[dataFrameHeaderSize:]
+	c.coalesceThreshold = len(c.sendBuf)
+	if dopts.CoalesceThreshold > 0 {
+		c.coalesceThreshold = min(dopts.CoalesceThreshold, len(c.sendBuf))
+	}
+	if dopts.RawFrames {
+		c.rawFrames = make(chan Frame)
+		c.manualAck = true
+	}
+	if dopts.ReadBufferSize > 0 {
+		c.recvPeeker = bufio.NewReaderSize(c.recvPipe, dopts.ReadBufferSize)
+	}
+	c.recvMaxFrame = subprotoMaxFrameSize
+	if dopts.MaxRecvFrameSize > 0 {
+		c.recvMaxFrame = uint32(dopts.MaxRecvFrameSize)
+	}
+	c.sendRate.window, c.recvRate.window = defaultRateWindow, defaultRateWindow
+	if dopts.RateWindow > 0 {
+		c.sendRate.window, c.recvRate.window = dopts.RateWindow, dopts.RateWindow
+	}
+	if dopts.RateLimit > 0 {
+		c.sendLimiter = newRateLimiter(dopts.RateLimit, c.clock.Now())
+	}
+	if dopts.Reconnect {
+		c.sendUnacked = newRingBuffer(subprotoSendWindow)
+		c.sendWindow = subprotoSendWindow
+	}
+	if dopts.Resume != nil {
+		c.resumeFrom(dopts.Resume)
 	}
 	c.closeOnceFunc = sync.OnceFunc(func() {
-		close(c.sendNbCh)
+		c.cancel()
+		c.closeErr = c.netConn().Close()
+		c.closeWriters(c.Err())
+
+		// buffers can only go back to the pool once nothing can touch them
+		c.wg.Wait()
+		if c.ackTimer != nil {
+			c.ackTimer.Stop()
+		}
+		if len(c.sendBuf) == subprotoMaxFrameSize {
+			putFrameBuf(c.sendFrame)
+		}
+		c.sendFrame, c.sendBuf = nil, nil
+		c.recvPipe.release()
+
+		dopts.Transcript.close(c.Stats())
 	})
 
+	dopts.Transcript.open(dopts)
+
+	c.wg.Add(2)
 	go c.read()
 	go c.write()
 
+	if dopts.LifetimeContext != nil {
+		go c.closeOnDone(dopts.LifetimeContext)
+	}
+	if c.idleTimeout > 0 {
+		c.touch()
+		go c.closeWhenIdle()
+	}
+	if dopts.KeepAlive > 0 {
+		missedLimit := defaultKeepAliveMissedLimit
+		if dopts.KeepAliveMissed != nil {
+			missedLimit = *dopts.KeepAliveMissed
+		}
+		go c.keepAlive(dopts.KeepAlive, missedLimit)
+	}
+
 	return c
 }
 
+// netConn returns the underlying connection, which may be replaced on reconnect.
+func (c *Conn) netConn() net.Conn {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	return c.conn
+}
+
 // LocalAddr returns the local network address.
 func (c *Conn) LocalAddr() net.Addr {
-	return c.conn.LocalAddr()
+	return c.netConn().LocalAddr()
 }
 
-// RemoteAddr returns the remote network address.
+// RemoteAddr returns the address of the destination as instance:port or host:port.
+// If the destination isn't known, it returns the address of the relay.
 func (c *Conn) RemoteAddr() net.Addr {
-	return c.conn.RemoteAddr()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.netConn().RemoteAddr()
 }
 
 // SetDeadline sets the read and write deadlines associated with the connection.
 func (c *Conn) SetDeadline(t time.Time) error {
-	return c.conn.SetDeadline(t)
+	c.SetReadDeadline(t)
+	c.SetWriteDeadline(t)
+	return nil
 }
 
-// SetReadDeadline sets the deadline for future Read calls.
+// SetReadDeadline sets the deadline for future and pending Read and Peek calls.
+// The deadline doesn't affect the connection to the relay.
 func (c *Conn) SetReadDeadline(t time.Time) error {
-	return c.conn.SetReadDeadline(t)
+	c.recvPipe.readDeadline.set(t)
+	return nil
 }
 
-// SetWriteDeadline sets the deadline for future Write calls.
+// SetWriteDeadline sets the deadline for future and pending Write calls.
+// The deadline doesn't affect the connection to the relay, so a Write that times
+// out may still have its data sent later.
 func (c *Conn) SetWriteDeadline(t time.Time) error {
-	return c.conn.SetWriteDeadline(t)
+	c.writeDeadline.set(t)
+	return nil
 }
 
-// Close closes the connection.
+// Close closes the connection and waits for its goroutines to exit.
 func (c *Conn) Close() error {
+	return c.closeWithError(net.ErrClosed)
+}
+
+// CloseGracefully stops accepting writes, sends any buffered data and waits for the
+// relay to ack retained data before closing the connection. If ctx is done first,
+// the connection is closed immediately and the returned error wraps ctx.Err().
+func (c *Conn) CloseGracefully(ctx context.Context) error {
+	c.sendClosed.Store(true)
+
+	drained := make(chan error, 1)
+	go func() {
+		// wait for a Write in progress to finish
+		c.writeMu.Lock()
+		c.writeMu.Unlock()
+
+		err := c.Flush()
+		if err == nil && c.sendUnacked != nil {
+			err = c.waitSendAcked()
+		}
+		drained <- err
+	}()
+
+	select {
+	case err := <-drained:
+		if err != nil {
+			c.closeWithError(err)
+			return err
+		}
+		return c.Close()
+	case <-ctx.Done():
+		c.Close()
+		return fmt.Errorf("failed to close gracefully: %w", ctx.Err())
+	}
+}
+
+// CloseWrite would signal the end of the data sent to the destination while still
+// reading its reply, but the relay has no way to do that. The subprotocol has no
+// end-of-stream frame, and closing the WebSocket closes both directions, so it
+// always returns errors.ErrUnsupported and leaves the connection open. Callers that
+// need the destination to see EOF have to Close the connection, or agree on an end
+// marker with the destination.
+func (c *Conn) CloseWrite() error {
+	return errors.ErrUnsupported
+}
+
+func (c *Conn) closeWithError(err error) error {
+	c.setErr(err)
 	c.closeOnceFunc()
-	return c.conn.Close()
+	return c.closeErr
+}
+
+func (c *Conn) closeOnDone(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		c.closeWithError(ctx.Err())
+	case <-c.ctx.Done():
+	}
+}
+
+// touch records activity on the connection for the idle timeout.
+func (c *Conn) touch() {
+	if c.idleTimeout > 0 {
+		c.lastActivity.Store(c.clock.Now().UnixNano())
+	}
+}
+
+func (c *Conn) closeWhenIdle() {
+	timer := c.clock.NewTimer(c.idleTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C():
+			idle := c.clock.Now().Sub(time.Unix(0, c.lastActivity.Load()))
+			if idle >= c.idleTimeout {
+				c.closeWithError(ErrIdleTimeout)
+				return
+			}
+			timer.Reset(c.idleTimeout - idle)
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// Err returns the error that terminated the connection, or nil if it is still open.
+func (c *Conn) Err() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
+func (c *Conn) setErr(err error) {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
 }
 
 // Read reads data from the connection.
 func (c *Conn) Read(buf []byte) (n int, err error) {
-	return c.recvReader.Read(buf)
+	if c.rawFrames != nil {
+		return 0, errRawFrames
+	}
+
+	c.recvMu.Lock()
+	defer c.recvMu.Unlock()
+
+	if c.recvPeeker != nil {
+		return c.recvPeeker.Read(buf)
+	}
+	return c.recvPipe.Read(buf)
+}
+
+// Peek returns the next n bytes without consuming them, blocking until they
+// are available. Subsequent calls to Read return the peeked bytes first.
+// If fewer than n bytes are returned, err explains why. n must not exceed
+// the read buffer size, or MaxFrameSize if it isn't set.
+func (c *Conn) Peek(n int) ([]byte, error) {
+	if c.rawFrames != nil {
+		return nil, errRawFrames
+	}
+
+	c.recvMu.Lock()
+	defer c.recvMu.Unlock()
+
+	if c.recvPeeker == nil {
+		c.recvPeeker = bufio.NewReaderSize(c.recvPipe, subprotoMaxFrameSize)
+	}
+	return c.recvPeeker.Peek(n)
 }
 
-// Write writes data to the connection.
+// Write writes data to the connection. If it returns an error, n is the number
+// of bytes from buf that were sent in frames before the error. When writes are
+// coalesced, bytes count as written once buffered, and buffered bytes from
+// earlier writes are lost if a later flush fails. If the write deadline passes
+// while data is being sent, sending stops as it does for WriteContext and n counts
+// the bytes that were sent.
+// With WithReconnect, a write larger than the send window is sent as acks free up
+// room, and Write returns once all of it has been sent.
 func (c *Conn) Write(buf []byte) (n int, err error) {
-	c.sendNbCh <- len(buf)
-	return c.sendWriter.Write(buf)
+	return c.WriteContext(context.Background(), buf)
+}
+
+// WriteContext is like Write, but if ctx is done while data is being sent, it
+// stops sending and returns how many bytes from buf were sent along with ctx.Err().
+// Sending stops between batches of frames, including while waiting for room in the
+// send window. It doesn't wait for a batch already being written, which is counted
+// as sent since it's delivered unless the connection fails.
+func (c *Conn) WriteContext(ctx context.Context, buf []byte) (n int, err error) {
+	c.touch()
+
+	if c.sendClosed.Load() {
+		return 0, net.ErrClosed
+	}
+
+	// serialize concurrent writers so their data is never interleaved
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if isClosedChan(c.writeDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	// wait out the result of an earlier Write that timed out
+	if c.sendResPending {
+		select {
+		case <-c.sendResCh:
+			c.sendResPending = false
+		case <-c.writeDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+
+	c.sendAbortMu.Lock()
+	c.sendAborted = false
+	c.sendCopied = 0
+	c.sendAbortMu.Unlock()
+
+	select {
+	case c.sendCh <- buf:
+	case <-c.writeDone:
+		return 0, c.Err()
+	case <-c.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	select {
+	case res := <-c.sendResCh:
+		return res.n, res.err
+	case <-c.writeDeadline.wait():
+		return c.abortWrite(os.ErrDeadlineExceeded)
+	case <-ctx.Done():
+		return c.abortWrite(ctx.Err())
+	}
+}
+
+// abortWrite stops the current Write, returning err with the result of the write
+// loop if it's ready, or else with how much of the Write was copied to be sent.
+// Once aborted, the write loop won't touch the Write's buffer again.
+func (c *Conn) abortWrite(err error) (int, error) {
+	select {
+	case res := <-c.sendResCh:
+		return res.n, err
+	default:
+	}
+
+	copied := c.abortSend()
+	// the write loop may be stuck writing to the relay
+	c.sendResPending = true
+	return copied, err
+}
+
+// abortSend stops the write loop sending the rest of the current Write, returning
+// how many bytes of it were copied to be sent.
+func (c *Conn) abortSend() int {
+	c.sendAbortMu.Lock()
+	c.sendAborted = true
+	copied := c.sendCopied
+	c.sendAbortMu.Unlock()
+
+	select {
+	case c.sendAbortCh <- struct{}{}:
+	default:
+	}
+	return copied
+}
+
+// isSendAborted reports whether the current Write was aborted.
+func (c *Conn) isSendAborted() bool {
+	c.sendAbortMu.Lock()
+	defer c.sendAbortMu.Unlock()
+	return c.sendAborted
+}
+
+// Flush sends any writes buffered by WithWriteCoalesce immediately.
+func (c *Conn) Flush() error {
+	errCh := make(chan error, 1)
+
+	select {
+	case c.flushCh <- errCh:
+		return <-errCh
+	case <-c.writeDone:
+		return c.Err()
+	}
+}
+
+// Raw returns the connection to the relay for diagnostics such as its addresses.
+// Reading from or writing to it corrupts the framing of the tunnel, and setting
+// deadlines on it can close it. It is replaced when WithReconnect reconnects.
+func (c *Conn) Raw() net.Conn {
+	return unwrapConn(c.netConn())
+}
+
+// HandshakeResponse returns the response to the WebSocket handshake with the relay,
+// or nil if the Conn was not dialed. The body is always empty.
+func (c *Conn) HandshakeResponse() *http.Response {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	return c.handshakeResp
+}
+
+// Ping sends a WebSocket ping to the relay and returns how long the pong took,
+// which measures latency to the relay rather than to the destination. Pongs are
+// read by the read loop, which waits for received data to be read first, so Ping
+// only completes while nothing is waiting to be read. It returns
+// errors.ErrUnsupported if the connection to the relay isn't a WebSocket.
+func (c *Conn) Ping(ctx context.Context) (time.Duration, error) {
+	pinger, ok := unwrapConn(c.netConn()).(interface{ Ping(context.Context) error })
+	if !ok {
+		return 0, errors.ErrUnsupported
+	}
+
+	start := time.Now()
+	if err := pinger.Ping(ctx); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// Backend returns the value of the header named by WithBackendHeader in the latest
+// handshake response. It returns an empty string without the option or if the
+// header wasn't sent. The relay isn't known to send such a header itself, so this
+// is for relays or proxies in front of it that do.
+func (c *Conn) Backend() string {
+	resp := c.HandshakeResponse()
+	if resp == nil || c.dopts.BackendHeader == "" {
+		return ""
+	}
+	return resp.Header.Get(c.dopts.BackendHeader)
 }
 
-// Connected returns whether the connection is established.
+// Connected reports whether the connection is established and still usable. It is
+// false until the relay accepts the connection and again once it's torn down, see
+// IsClosed to tell the two apart.
 func (c *Conn) Connected() bool {
-	return c.connected
+	select {
+	case <-c.connectedCh:
+		return !c.IsClosed()
+	default:
+		return false
+	}
+}
+
+// IsClosed reports whether the connection has been torn down, either by Close or
+// because it failed, in which case Err returns why. A Conn is never reopened, though
+// WithReconnect replaces the connection to the relay without closing the Conn.
+func (c *Conn) IsClosed() bool {
+	return c.closed.Load()
+}
+
+// Done returns a channel that's closed once the connection has been torn down, when
+// IsClosed starts reporting true.
+func (c *Conn) Done() <-chan struct{} {
+	return c.closedCh
+}
+
+// WaitConnected blocks until the connection is established, the connection fails, or ctx is done.
+func (c *Conn) WaitConnected(ctx context.Context) error {
+	select {
+	case <-c.connectedCh:
+		return nil
+	case <-c.readDone:
+		return c.Err()
+	case <-c.ctx.Done():
+		return c.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // SessionID returns the session ID of the connection. This is only valid after the connection is established.
@@ -240,86 +931,214 @@ func (c *Conn) SessionID() string {
 	return string(c.sessionID)
 }
 
+// CorrelationID returns the ID set with WithCorrelationID, or an empty string.
+func (c *Conn) CorrelationID() string {
+	return c.dopts.CorrelationID
+}
+
 // Sent returns the number of bytes sent and acked.
 func (c *Conn) Sent() uint64 {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
 	return c.sendNbAcked
 }
 
 // Received returns the number of bytes received and acked.
 func (c *Conn) Received() uint64 {
+	c.ackMu.Lock()
+	defer c.ackMu.Unlock()
 	return c.recvNbAcked
 }
 
-func (c *Conn) closeWriters(err error) {
-	c.sendWriter.CloseWithError(err)
-	c.recvWriter.CloseWithError(err)
+// Ack acks all data received so far. It is only needed with WithManualAck.
+func (c *Conn) Ack() error {
+	c.lockAck()
+	defer c.unlockAck()
+	return c.ack()
 }
 
-func (c *Conn) readSuccessFrame(r io.Reader) error {
-	bytes := [4]byte{}
-	if _, err := r.Read(bytes[:]); err != nil {
+// lockAck locks the connection for writing an ack. The connection lock is
+// always taken first since a reconnect holds it while updating the ack state.
+func (c *Conn) lockAck() {
+	c.connMu.RLock()
+	c.ackMu.Lock()
+}
+
+func (c *Conn) unlockAck() {
+	c.ackMu.Unlock()
+	c.connMu.RUnlock()
+}
+
+// ackWhenQuiet acks data received since the last ack, called once no data has
+// arrived for the delay set by WithAckDelay.
+func (c *Conn) ackWhenQuiet() {
+	c.lockAck()
+	defer c.unlockAck()
+
+	if c.ctx.Err() != nil || c.recvNbUnacked <= c.recvNbAcked {
+		return
+	}
+	// if the connection is broken the read loop finds out too
+	c.ack()
+}
+
+// ack acks all data received so far. It must be called between lockAck and unlockAck.
+func (c *Conn) ack() error {
+	nb := c.recvNbUnacked
+	if err := c.writeAck(nb); err != nil {
 		return err
 	}
-	len := binary.BigEndian.Uint32(bytes[:])
+	c.recvNbAcked = nb
+	return nil
+}
 
-	if len > subprotoMaxFrameSize {
-		return &ProtocolError{"len exceeds subprotocol max data frame size"}
+// maybeAck acks received data once it passes the ack threshold.
+func (c *Conn) maybeAck() error {
+	c.lockAck()
+	defer c.unlockAck()
+
+	if c.manualAck || !c.shouldAck() {
+		return nil
 	}
+	return c.ack()
+}
 
-	c.sessionID = make([]byte, len)
-	if _, err := r.Read(c.sessionID); err != nil {
+func (c *Conn) closeWriters(err error) {
+	c.closed.Store(true)
+	c.setErr(err)
+	c.recvPipe.CloseWithError(err)
+	c.closedOnce.Do(func() {
+		close(c.closedCh)
+	})
+}
+
+func (c *Conn) readSuccessFrame(r io.Reader) error {
+	frame, err := readFrameBody(r, subprotoTagSuccess, subprotoMaxFrameSize, 0)
+	if err != nil {
 		return err
 	}
 
-	c.connected = true
+	c.setSessionID(frame.Payload)
 	return nil
 }
 
+// setSessionID records the session ID from a success frame, establishing the
+// connection if it's the first.
+func (c *Conn) setSessionID(sessionID []byte) {
+	c.sessionID = sessionID
+
+	if !c.connected {
+		c.connected = true
+		close(c.connectedCh)
+
+		c.dopts.Transcript.event("connected", map[string]any{})
+		if c.dopts.OnConnect != nil {
+			c.dopts.OnConnect(string(c.sessionID))
+		}
+	}
+}
+
 func (c *Conn) writeAck(nb uint64) error {
 	_, err := c.conn.Write(makeAckFrame(nb))
 	return err
 }
 
+// shouldAck reports whether enough data has been received since the last ack.
+func (c *Conn) shouldAck() bool {
+	// the acked count must never run ahead of the received count, but check
+	// so a bug can't underflow the delta and trigger spurious acks
+	if c.recvNbAcked > c.recvNbUnacked {
+		return false
+	}
+	return c.recvNbUnacked-c.recvNbAcked > subprotoAckThreshold
+}
+
 func (c *Conn) readAckFrame(r io.Reader) error {
-	bytes := [8]byte{}
-	if _, err := r.Read(bytes[:]); err != nil {
+	frame, err := readFrameBody(r, subprotoTagAck, 0, 0)
+	if err != nil {
 		return err
 	}
 
-	// NOTE: gcloud's implementation has retransmission logic
-	// but it seems redundant since all traffic is over TCP, so
-	// this is unimplemented
+	return c.ackSent(binary.BigEndian.Uint64(frame.Payload), false)
+}
 
-	c.sendNbAcked = binary.BigEndian.Uint64(bytes[:])
-	return nil
+func (c *Conn) readReconnectAckFrame(r io.Reader) error {
+	frame, err := readFrameBody(r, subprotoTagReconnectAck, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	// sent after a successful reconnect, carries the number of bytes
+	// the relay has received from us
+	return c.ackSent(binary.BigEndian.Uint64(frame.Payload), true)
 }
 
 func (c *Conn) readDataFrame(r io.Reader) error {
 	bytes := [4]byte{}
-	if _, err := r.Read(bytes[:]); err != nil {
-		return err
+	if _, err := io.ReadFull(r, bytes[:]); err != nil {
+		return unexpectedEOF(err)
 	}
 	len := binary.BigEndian.Uint32(bytes[:])
 
-	if len > subprotoMaxFrameSize {
-		return &ProtocolError{"len exceeds subprotocol max data frame size"}
+	if len > c.recvMaxFrame {
+		c.ackMu.Lock()
+		received := c.recvNbUnacked
+		c.ackMu.Unlock()
+
+		return newFrameTooLargeError(len, c.recvMaxFrame, received)
+	}
+	if len == 0 {
+		return nil
 	}
 
-	if _, err := copyNBuffer(c.recvWriter, r, int64(len), c.recvBuf); err != nil {
+	if _, err := c.recvPipe.readFrom(r, int(len)); err != nil {
 		return err
 	}
 
+	c.ackMu.Lock()
 	c.recvNbUnacked += uint64(len)
+	c.ackMu.Unlock()
+	c.resetAckTimer()
+	c.recvRate.add(int(len), c.clock.Now())
+	c.touch()
 	return nil
 }
 
+// resetAckTimer restarts the wait for data to stop arriving before acking it.
+func (c *Conn) resetAckTimer() {
+	if c.ackDelay == 0 || c.manualAck {
+		return
+	}
+
+	if c.ackTimer == nil {
+		c.ackTimer = c.clock.AfterFunc(c.ackDelay, c.ackWhenQuiet)
+	} else {
+		c.ackTimer.Reset(c.ackDelay)
+	}
+}
+
+// readFrame reads and handles one frame from the relay. A WebSocket message can
+// hold part of a frame or several frames, so it never assumes a read is complete.
+// It never reads past the end of the frame, never allocates more than the max
+// frame size for it, and returns a ProtocolError for anything it can't parse since
+// the rest of the stream can't be trusted after that.
 func (c *Conn) readFrame() error {
 	bytes := [2]byte{}
-	if _, err := c.conn.Read(bytes[:]); err != nil {
+	if _, err := io.ReadFull(c.conn, bytes[:]); err != nil {
 		return err
 	}
 	tag := binary.BigEndian.Uint16(bytes[:])
 
+	// the relay sends a single success frame, even after a reconnect, so another
+	// one would replace the session ID used to resume
+	if tag == subprotoTagSuccess && c.connected {
+		return newProtocolError(ErrDuplicateSuccessFrame)
+	}
+
+	if c.rawFrames != nil {
+		return c.readRawFrame(tag)
+	}
+
 	var err error
 
 	switch tag {
@@ -327,25 +1146,24 @@ func (c *Conn) readFrame() error {
 		err = c.readSuccessFrame(c.conn)
 	default:
 		if !c.connected {
-			return &ProtocolError{"expected success frame but not did receive one"}
+			return newProtocolError(ErrNoSuccessFrame)
 		}
 
 		switch tag {
+		case subprotoTagReconnectAck:
+			err = c.readReconnectAckFrame(c.conn)
 		case subprotoTagAck:
 			err = c.readAckFrame(c.conn)
 		case subprotoTagData:
 			err = c.readDataFrame(c.conn)
 
 			// can the threshold be increased?
-			if c.recvNbUnacked-c.recvNbAcked > subprotoAckThreshold {
-				if err := c.writeAck(c.recvNbUnacked); err != nil {
-					return err
-				}
-				c.recvNbAcked = c.recvNbUnacked
+			if err := c.maybeAck(); err != nil {
+				return err
 			}
 		default:
-			// unknown tags should be ignored
-			return nil
+			// the length of an unknown frame isn't known so it can't be skipped
+			return newUnknownTagError(tag)
 		}
 
 	}
@@ -353,37 +1171,155 @@ func (c *Conn) readFrame() error {
 	return err
 }
 
+// writeInitialData sends the data set by WithInitialData once the connection is
+// established, before anything passed to Write.
+func (c *Conn) writeInitialData() error {
+	if len(c.initialData) == 0 {
+		return nil
+	}
+
+	select {
+	case <-c.connectedCh:
+	case <-c.readDone:
+		return c.Err()
+	case <-c.ctx.Done():
+		return io.EOF
+	}
+
+	if _, err := c.bufferWrite(c.initialData); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
 func (c *Conn) writeFrame() error {
-	nb, ok := <-c.sendNbCh
-	if !ok {
+	select {
+	case <-c.ctx.Done():
 		// connection is closing
 		return io.EOF
+	case <-c.readDone:
+		return c.Err()
+	case buf := <-c.sendCh:
+		n, err := c.bufferWrite(buf)
+		c.sendResCh <- sendResult{n, err}
+		if err == os.ErrDeadlineExceeded {
+			// only the timed out Write failed, not the connection
+			return nil
+		}
+		return err
+	case <-c.flushTimer:
+		return c.flush()
+	case errCh := <-c.flushCh:
+		err := c.flush()
+		errCh <- err
+		return err
 	}
+}
 
-	for nb > 0 {
-		// clamp each write to max frame size
-		writeNb := min(nb, subprotoMaxFrameSize)
-		nb -= writeNb
+// bufferWrite stages buf in frame sized chunks, flushing them unless writes are coalesced.
+func (c *Conn) bufferWrite(buf []byte) (int, error) {
+	var n int
+
+	for n < len(buf) {
+		// send what's left of a large write in batches of frames when nothing
+		// is buffered
+		if c.coalesceDelay == 0 && c.sendPending == 0 && len(buf)-n > subprotoMaxFrameSize {
+			sent, err := c.writeBatch(buf[n:])
+			if err != nil {
+				return n, err
+			}
+			c.sendRate.add(sent, c.clock.Now())
+			n += sent
+			continue
+		}
 
-		buf := make([]byte, writeNb)
-		if _, err := c.sendReader.Read(buf); err != nil {
-			return err
+		chunk := min(len(buf)-n, len(c.sendBuf)-c.sendPending)
+		if c.sendLimiter != nil {
+			chunk = min(chunk, subprotoMaxFrameSize)
+		}
+		if err := c.waitRateLimit(chunk); err != nil {
+			return n, err
 		}
 
-		if _, err := c.conn.Write(makeDataFrame(buf)); err != nil {
-			return err
+		c.sendAbortMu.Lock()
+		if c.sendAborted {
+			c.sendAbortMu.Unlock()
+			return n, os.ErrDeadlineExceeded
 		}
+		copied := copy(c.sendBuf[c.sendPending:], buf[n:n+chunk])
+		c.sendCopied += copied
+		c.sendAbortMu.Unlock()
+		c.sendPending += copied
+
+		if c.coalesceDelay == 0 || c.sendPending >= c.coalesceThreshold {
+			if err := c.flush(); err != nil {
+				// the failed frame wasn't delivered so don't count it
+				return n, err
+			}
+		}
+		n += copied
 	}
 
-	return nil
+	if c.sendPending > 0 && c.flushTimer == nil {
+		c.flushTimer = c.clock.NewTimer(c.coalesceDelay).C()
+	}
+
+	return n, nil
+}
+
+func (c *Conn) flush() error {
+	c.flushTimer = nil
+	if c.sendPending == 0 {
+		return nil
+	}
+
+	buf := c.sendBuf[:c.sendPending]
+	c.sendPending = 0
+
+	var err error
+	switch {
+	case c.sendUnacked != nil:
+		for sent := 0; sent < len(buf) && err == nil; {
+			n := min(len(buf)-sent, c.batchSize())
+			err = c.writeRetained(buf[sent : sent+n])
+			sent += n
+		}
+	case len(buf) > subprotoMaxFrameSize:
+		err = c.writeDataFrames(c.conn, buf)
+	default:
+		// send the header and data with a single write, so they share a WebSocket
+		// message
+		binary.BigEndian.PutUint32(c.sendFrame[2:dataFrameHeaderSize], uint32(len(buf)))
+		_, err = c.conn.Write(c.sendFrame[:dataFrameHeaderSize+len(buf)])
+	}
+	if err == nil {
+		c.sendRate.add(len(buf), c.clock.Now())
+	}
+	return err
 }
 
 func (c *Conn) read() {
+	defer c.wg.Done()
+	defer close(c.readDone)
+
 	for {
 		if err := c.readFrame(); err != nil {
+			err = messageError(err)
+			if c.shouldReconnect(err) {
+				if err = c.reconnect(); err == nil {
+					continue
+				}
+			}
+
+			// the WebSocket NetConn already reports a normal closure as io.EOF,
+			// but other conns may not
 			var closeError websocket.CloseError
 			if errors.As(err, &closeError) {
-				err = &CloseError{int(closeError.Code), closeError.Reason}
+				if closeError.Code == websocket.StatusNormalClosure {
+					err = io.EOF
+				} else {
+					err = &CloseError{int(closeError.Code), closeError.Reason}
+				}
 			}
 
 			c.closeWriters(err)
@@ -392,16 +1328,35 @@ func (c *Conn) read() {
 	}
 }
 
+// messageError returns a ProtocolError if err is from the WebSocket NetConn reading
+// a message that isn't binary or is over the read limit, and err otherwise. The
+// NetConn closes the connection but returns these errors from fmt.Errorf, with no
+// sentinel or type to match and the close status only sent to the relay, so they can
+// only be told apart by their text. TestReadLimit and TestTextMessage catch the
+// text changing in a new version of the websocket package.
+func messageError(err error) error {
+	switch msg := err.Error(); {
+	case strings.Contains(msg, "unexpected frame type read"):
+		return newProtocolError(ErrNonBinaryMessage)
+	case strings.Contains(msg, "read limited at"):
+		return newProtocolError(ErrMessageTooLarge)
+	}
+	return err
+}
+
 func (c *Conn) write() {
-	for {
-		if err := c.writeFrame(); err != nil {
-			var closeError websocket.CloseError
-			if errors.As(err, &closeError) {
-				err = &CloseError{int(closeError.Code), closeError.Reason}
-			}
+	defer c.wg.Done()
+	defer close(c.writeDone)
 
-			c.closeWriters(err)
-			break
-		}
+	err := c.writeInitialData()
+	for err == nil {
+		err = c.writeFrame()
 	}
+
+	var closeError websocket.CloseError
+	if errors.As(err, &closeError) {
+		err = &CloseError{int(closeError.Code), closeError.Reason}
+	}
+
+	c.closeWriters(err)
 }
@@ -1,17 +1,36 @@
 package iap
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/coder/websocket"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
 )
 
 var testData = []byte("hello")
@@ -78,6 +97,389 @@ func TestAckFrame(t *testing.T) {
 	})
 }
 
+func TestEmptyFrames(t *testing.T) {
+	t.Run("Data", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r)
+		defer conn.Close()
+
+		w.Write(makeSuccessFrame(randomString()))
+		w.Write(makeDataFrame(nil))
+		go w.Write(makeDataFrame(testData))
+
+		buf := make([]byte, 2*len(testData))
+		n, err := conn.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, testData, buf[:n])
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r)
+		defer conn.Close()
+
+		w.Write(makeSuccessFrame(""))
+
+		_, err := conn.Read(make([]byte, 1))
+		var protocolError *ProtocolError
+		assert.ErrorAs(t, err, &protocolError)
+		assert.False(t, conn.Connected())
+	})
+}
+
+func TestMaxRecvFrameSize(t *testing.T) {
+	r, w := net.Pipe()
+	defer w.Close()
+
+	conn := NewConn(r, WithMaxRecvFrameSize(4))
+	defer conn.Close()
+
+	w.Write(makeSuccessFrame(randomString()))
+	go func() {
+		w.Write(makeDataFrame([]byte("abcd")))
+		w.Write(makeDataFrame([]byte("abcde")))
+	}()
+
+	buf := make([]byte, 8)
+	n, err := conn.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "abcd", string(buf[:n]))
+
+	_, err = conn.Read(buf)
+	var protocolError *ProtocolError
+	assert.ErrorAs(t, err, &protocolError)
+	assert.ErrorIs(t, err, ErrFrameTooLarge)
+
+	for _, n := range []int{-1, MaxFrameSize + 1} {
+		_, err := Dial(context.Background(), WithMaxRecvFrameSize(n))
+		var configError *ConfigError
+		assert.ErrorAs(t, err, &configError)
+		assert.ErrorContains(t, err, "or 0 for the default")
+	}
+
+	// 0 leaves the default in place
+	dopts := &dialOptions{}
+	dopts.collectOpts([]DialOption{WithMaxRecvFrameSize(0)})
+	assert.NoError(t, dopts.validate())
+
+	// the sizes are set by the relay, so they must never change
+	assert.Equal(t, 16384, MaxFrameSize)
+	assert.Equal(t, 32768, AckThreshold)
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	r, w := net.Pipe()
+	defer w.Close()
+
+	conn := NewConn(r)
+	defer conn.Close()
+
+	header := make([]byte, 6)
+	binary.BigEndian.PutUint16(header[0:2], subprotoTagData)
+	binary.BigEndian.PutUint32(header[2:6], subprotoMaxFrameSize+1)
+
+	go func() {
+		w.Write(makeSuccessFrame(randomString()))
+		w.Write(makeDataFrame(testData))
+		w.Write(header)
+	}()
+
+	buf := make([]byte, len(testData))
+	_, err := io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+
+	_, err = conn.Read(buf)
+	assert.ErrorIs(t, err, ErrFrameTooLarge)
+	assert.EqualError(t, err, fmt.Sprintf("protocol error: frame too large: length %d exceeds max %d at data offset %d",
+		subprotoMaxFrameSize+1, subprotoMaxFrameSize, len(testData)))
+}
+
+func TestTextMessage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wsConn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			Subprotocols: []string{proxySubproto},
+		})
+		if err != nil {
+			panic(err)
+		}
+		defer wsConn.CloseNow()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+
+		wsConn.Write(ctx, websocket.MessageBinary, makeSuccessFrame(randomString()))
+		wsConn.Write(ctx, websocket.MessageText, makeDataFrame(testData))
+		wsConn.Read(ctx)
+	}))
+	defer server.Close()
+
+	conn, err := dial(context.Background(), "ws://"+server.Listener.Addr().String(), WithReconnect())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Read(make([]byte, len(testData)))
+	assert.ErrorIs(t, err, ErrNonBinaryMessage)
+
+	var protocolError *ProtocolError
+	assert.ErrorAs(t, err, &protocolError)
+}
+
+func TestReadLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wsConn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			Subprotocols: []string{proxySubproto},
+		})
+		if err != nil {
+			panic(err)
+		}
+		defer wsConn.CloseNow()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+
+		wsConn.Write(ctx, websocket.MessageBinary, makeSuccessFrame(randomString()))
+		wsConn.Write(ctx, websocket.MessageBinary, makeDataFrame(make([]byte, 100)))
+		wsConn.Read(ctx)
+	}))
+	defer server.Close()
+
+	conn, err := dial(context.Background(), "ws://"+server.Listener.Addr().String(), WithReadLimit(64))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, err = io.ReadFull(conn, make([]byte, 100))
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+
+	var protocolError *ProtocolError
+	assert.ErrorAs(t, err, &protocolError)
+
+	dopts := &dialOptions{}
+	assert.Equal(t, int64(16*MaxFrameSize), dopts.readLimit())
+
+	dopts.collectOpts([]DialOption{WithReadLimit(-1)})
+	var configError *ConfigError
+	assert.ErrorAs(t, dopts.validate(), &configError)
+}
+
+func TestFragmentedFrames(t *testing.T) {
+	large := make([]byte, subprotoMaxFrameSize)
+	for i := range large {
+		large[i] = byte(i)
+	}
+
+	success := makeSuccessFrame(randomString())
+	stream := append(append(success, makeDataFrame(large)...), makeDataFrame(testData)...)
+	want := append(append([]byte(nil), large...), testData...)
+
+	// offsets of the large data frame's tag, length and payload
+	tag := len(success)
+	length := tag + 2
+	payload := length + 4
+
+	every := func(n int) []int {
+		var splits []int
+		for i := n; i < len(stream); i += n {
+			splits = append(splits, i)
+		}
+		return splits
+	}
+
+	tests := []struct {
+		name   string
+		splits []int
+	}{
+		{"One message", nil},
+		{"Message per frame", []int{tag, payload + len(large)}},
+		{"Tag split", []int{tag + 1}},
+		{"Length split", []int{length + 1, length + 3}},
+		{"Payload split", []int{payload + 1, payload + len(large)/2, payload + len(large) - 1}},
+		{"Every 7 bytes", every(7)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				wsConn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+					Subprotocols: []string{proxySubproto},
+				})
+				if err != nil {
+					panic(err)
+				}
+				defer wsConn.CloseNow()
+
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+				defer cancel()
+
+				var start int
+				for _, end := range append(test.splits, len(stream)) {
+					if err := wsConn.Write(ctx, websocket.MessageBinary, stream[start:end]); err != nil {
+						return
+					}
+					start = end
+				}
+				for {
+					if _, _, err := wsConn.Read(ctx); err != nil {
+						return
+					}
+				}
+			}))
+			defer server.Close()
+
+			conn, err := dial(context.Background(), "ws://"+server.Listener.Addr().String())
+			assert.NoError(t, err)
+			defer conn.Close()
+
+			got := make([]byte, len(want))
+			_, err = io.ReadFull(conn, got)
+			assert.NoError(t, err)
+			assert.Equal(t, want, got)
+		})
+	}
+
+	t.Run("Truncated", func(t *testing.T) {
+		r, w := net.Pipe()
+
+		conn := NewConn(r)
+		defer conn.Close()
+
+		go io.Copy(io.Discard, w)
+
+		// the relay goes away after the tag of a data frame
+		w.Write(makeSuccessFrame(randomString()))
+		w.Write(makeDataFrame(testData)[:2])
+		w.Close()
+
+		_, err := conn.Read(make([]byte, len(testData)))
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+}
+
+func TestNoSuccessFrame(t *testing.T) {
+	r, w := net.Pipe()
+	defer w.Close()
+
+	conn := NewConn(r)
+	defer conn.Close()
+
+	go w.Write(makeDataFrame(testData))
+
+	_, err := conn.Read(make([]byte, len(testData)))
+	assert.ErrorIs(t, err, ErrNoSuccessFrame)
+
+	var protocolError *ProtocolError
+	assert.ErrorAs(t, err, &protocolError)
+}
+
+func TestDuplicateSuccessFrame(t *testing.T) {
+	r, w := net.Pipe()
+	defer w.Close()
+
+	var reconnects int
+	conn := NewConn(r, WithReconnect(), WithReconnectCallback(func(int, error) { reconnects++ }))
+	defer conn.Close()
+
+	sessionID := randomString()
+	go func() {
+		w.Write(makeSuccessFrame(sessionID))
+		w.Write(makeSuccessFrame(randomString()))
+	}()
+
+	_, err := conn.Read(make([]byte, len(testData)))
+	assert.ErrorIs(t, err, ErrDuplicateSuccessFrame)
+
+	var protocolError *ProtocolError
+	assert.ErrorAs(t, err, &protocolError)
+
+	// the session isn't replaced and a protocol error isn't worth reconnecting over
+	assert.Equal(t, sessionID, conn.SessionID())
+	assert.Zero(t, reconnects)
+}
+
+func TestUnknownFrameTag(t *testing.T) {
+	r, w := net.Pipe()
+	defer w.Close()
+
+	conn := NewConn(r)
+	defer conn.Close()
+
+	// the relay has no error frame, so a frame it might send in the future can't
+	// be skipped and ends the connection with the tag in the error
+	go func() {
+		w.Write(makeSuccessFrame(randomString()))
+		w.Write([]byte{0x0, 0x3, 0x0, 0x0, 0x0, 0x0})
+	}()
+
+	_, err := conn.Read(make([]byte, len(testData)))
+	var protocolError *ProtocolError
+	assert.ErrorAs(t, err, &protocolError)
+	assert.ErrorContains(t, err, "unknown frame tag 0x3")
+}
+
+func FuzzReadFrame(f *testing.F) {
+	success := makeSuccessFrame(randomString())
+	concat := func(frames ...[]byte) []byte {
+		return bytes.Join(frames, nil)
+	}
+
+	f.Add(success)
+	f.Add(concat(success, makeDataFrame(testData)))
+	f.Add(concat(success, makeAckFrame(5), makeDataFrame(testData)))
+	f.Add(concat(success, makeReconnectAckFrame(5)))
+	f.Add(concat(success, makeDataFrame(make([]byte, subprotoMaxFrameSize))))
+	f.Add(concat(success, makeDataFrame(testData))[:len(success)+4])
+	f.Add(concat(success, []byte{0xff, 0xff}))
+	f.Add(makeDataFrame(testData))
+	f.Add(success[:3])
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r)
+		defer conn.Close()
+
+		go io.Copy(io.Discard, w)
+		go func() {
+			w.Write(data)
+			w.Close()
+		}()
+
+		// the read loop must end once the input runs out, however it's malformed
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := io.Copy(io.Discard, conn)
+		assert.NotErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+}
+
+func TestReconnectAckFrame(t *testing.T) {
+	t.Run("Write", func(t *testing.T) {
+		buf := makeReconnectAckFrame(0x1337)
+		assert.Len(t, buf, 10)
+		assert.Equal(t, []byte{0x0, 0x2}, buf[0:2])
+	})
+
+	t.Run("Read", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r)
+		defer conn.Close()
+
+		w.Write(makeSuccessFrame(randomString()))
+		w.Write(makeReconnectAckFrame(0x1337))
+		// ensure the ack has been processed
+		go w.Write(makeDataFrame(testData))
+		conn.Read(make([]byte, len(testData)))
+
+		assert.Equal(t, uint64(0x1337), conn.Sent())
+	})
+}
+
 func TestDataFrame(t *testing.T) {
 	t.Run("Write", func(t *testing.T) {
 		buf := makeDataFrame([]byte{0x13, 0x37})
@@ -88,16 +490,171 @@ func TestDataFrame(t *testing.T) {
 	})
 }
 
+func TestDecodeFrame(t *testing.T) {
+	uint64Bytes := func(n uint64) []byte {
+		return binary.BigEndian.AppendUint64(nil, n)
+	}
+	maxData := bytes.Repeat([]byte{0xaa}, subprotoMaxFrameSize)
+
+	tests := []struct {
+		name    string
+		encoded []byte
+		want    Frame
+	}{
+		{"Success", makeSuccessFrame("s"), Frame{FrameTagSuccess, []byte("s")}},
+		{"Success max length", makeSuccessFrame(string(maxData)), Frame{FrameTagSuccess, maxData}},
+		{"Data empty", makeDataFrame(nil), Frame{FrameTagData, []byte{}}},
+		{"Data", makeDataFrame(testData), Frame{FrameTagData, testData}},
+		{"Data max length", makeDataFrame(maxData), Frame{FrameTagData, maxData}},
+		{"Ack zero", makeAckFrame(0), Frame{FrameTagAck, uint64Bytes(0)}},
+		{"Ack max", makeAckFrame(math.MaxUint64), Frame{FrameTagAck, uint64Bytes(math.MaxUint64)}},
+		{"Reconnect ack", makeReconnectAckFrame(0x1337), Frame{FrameTagReconnectAck, uint64Bytes(0x1337)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := bytes.NewReader(test.encoded)
+
+			frame, err := decodeFrame(r, subprotoMaxFrameSize)
+			assert.NoError(t, err)
+			assert.Equal(t, test.want, frame)
+			assert.Zero(t, r.Len())
+
+			// every strict prefix is cut off partway through the frame
+			for _, n := range []int{1, 2, 5, len(test.encoded) - 1} {
+				if n >= len(test.encoded) {
+					continue
+				}
+				_, err := decodeFrame(bytes.NewReader(test.encoded[:n]), subprotoMaxFrameSize)
+				assert.ErrorIs(t, err, io.ErrUnexpectedEOF, "prefix of %d bytes", n)
+			}
+		})
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		_, err := decodeFrame(bytes.NewReader(nil), subprotoMaxFrameSize)
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("Over max length", func(t *testing.T) {
+		_, err := decodeFrame(bytes.NewReader(makeDataFrame(append(maxData, 0))), subprotoMaxFrameSize)
+		assert.ErrorIs(t, err, ErrFrameTooLarge)
+
+		_, err = decodeFrame(bytes.NewReader(makeDataFrame(testData)), uint32(len(testData)-1))
+		assert.ErrorIs(t, err, ErrFrameTooLarge)
+	})
+
+	t.Run("Empty success", func(t *testing.T) {
+		_, err := decodeFrame(bytes.NewReader(makeSuccessFrame("")), subprotoMaxFrameSize)
+		var protocolError *ProtocolError
+		assert.ErrorAs(t, err, &protocolError)
+	})
+
+	t.Run("Unknown tag", func(t *testing.T) {
+		_, err := decodeFrame(bytes.NewReader([]byte{0xff, 0xff, 0, 0}), subprotoMaxFrameSize)
+		var protocolError *ProtocolError
+		assert.ErrorAs(t, err, &protocolError)
+	})
+}
+
 func TestConn(t *testing.T) {
+	t.Run("Raw", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r)
+		defer conn.Close()
+		assert.Same(t, r, conn.Raw())
+
+		r2, w2 := net.Pipe()
+		defer w2.Close()
+
+		captured := NewConn(r2, WithFrameCapture(io.Discard))
+		defer captured.Close()
+		assert.Same(t, r2, captured.Raw())
+	})
+
 	t.Run("With double Close", func(t *testing.T) {
 		r, _ := net.Pipe()
-		conn := newConn(r)
+		conn := NewConn(r)
+
+		assert.NoError(t, conn.Close())
+		assert.NoError(t, conn.Close())
+	})
+
+	t.Run("With lifetime context", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		conn := NewConn(r, WithLifetimeContext(ctx))
+		assert.NoError(t, conn.Err())
+
+		cancel()
+
+		assert.Eventually(t, func() bool {
+			return conn.Err() != nil
+		}, time.Second, time.Millisecond)
+		assert.ErrorIs(t, conn.Err(), context.Canceled)
+
+		_, err := conn.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("Write after Close", func(t *testing.T) {
+		r, _ := net.Pipe()
+		conn := NewConn(r)
 
 		assert.NoError(t, conn.Close())
+
+		_, err := conn.Write(testData)
+		assert.ErrorIs(t, err, net.ErrClosed)
+	})
+
+	t.Run("Err after Close", func(t *testing.T) {
+		r, _ := net.Pipe()
+		conn := NewConn(r)
+
 		assert.NoError(t, conn.Close())
+		assert.ErrorIs(t, conn.Err(), net.ErrClosed)
 	})
 }
 
+func TestNewConn(t *testing.T) {
+	client, relay := net.Pipe()
+	defer relay.Close()
+
+	conn := NewConn(client, WithReconnect())
+	defer conn.Close()
+
+	sessionID := randomString()
+	go func() {
+		relay.Write(makeSuccessFrame(sessionID))
+		relay.Write(makeDataFrame(testData))
+
+		buf := readTestDataFrame(t, relay)
+		relay.Write(makeAckFrame(uint64(len(buf))))
+		relay.Close()
+	}()
+
+	assert.NoError(t, conn.WaitConnected(context.Background()))
+	assert.Equal(t, sessionID, conn.SessionID())
+
+	buf := make([]byte, len(testData))
+	_, err := io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, testData, buf)
+
+	_, err = conn.Write(testData)
+	assert.NoError(t, err)
+
+	// there's nothing to redial, so the Conn ends with the pipe
+	_, err = conn.Read(buf)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, uint64(len(testData)), conn.Sent())
+	assert.Zero(t, conn.Stats().Reconnects)
+}
+
 func TestRead(t *testing.T) {
 	t.Run("E2E Read", func(t *testing.T) {
 		conn, err := dial(context.Background(), "ws://"+wsListener.Addr().String())
@@ -114,6 +671,53 @@ func TestRead(t *testing.T) {
 
 		assert.True(t, conn.Connected())
 		assert.NotEmpty(t, conn.SessionID())
+		assert.Equal(t, http.StatusSwitchingProtocols, conn.HandshakeResponse().StatusCode)
+	})
+
+	t.Run("After normal close", func(t *testing.T) {
+		conn, err := dial(context.Background(), "ws://"+wsListener.Addr().String())
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		// the test server closes normally after sending its data
+		buf, err := io.ReadAll(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, testData, buf)
+
+		_, err = conn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+	})
+
+	t.Run("After abnormal close", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			wsConn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+				Subprotocols: []string{proxySubproto},
+			})
+			if err != nil {
+				panic(err)
+			}
+			defer wsConn.CloseNow()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+			defer cancel()
+
+			wsConn.Write(ctx, websocket.MessageBinary, makeSuccessFrame(randomString()))
+			wsConn.Close(closeCodeNotAuthorized, "not authorized")
+		}))
+		defer server.Close()
+
+		conn, err := dial(context.Background(), "ws://"+server.Listener.Addr().String())
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		_, err = io.ReadAll(conn)
+		var closeError *CloseError
+		assert.ErrorAs(t, err, &closeError)
+		assert.Equal(t, closeCodeNotAuthorized, closeError.Code)
+
+		stats := conn.Stats()
+		assert.Equal(t, CloseReasonRelay, stats.CloseReason)
+		assert.Contains(t, stats.CloseDetail, "not authorized")
 	})
 
 	t.Run("Without ACK", func(t *testing.T) {
@@ -122,14 +726,14 @@ func TestRead(t *testing.T) {
 		defer r.Close()
 		defer w.Close()
 
-		conn := newConn(r)
+		conn := NewConn(r)
 		defer func() {
 			assert.NoError(t, conn.Close())
 		}()
 		assert.False(t, conn.Connected())
 
 		w.Write(makeSuccessFrame(randomString()))
-		w.Write(makeDataFrame(testData))
+		go w.Write(makeDataFrame(testData))
 
 		buf := make([]byte, len(testData))
 		n, err := conn.Read(buf)
@@ -143,21 +747,3763 @@ func TestRead(t *testing.T) {
 	})
 }
 
-func TestConnectURL(t *testing.T) {
-	url := connectURL(&dialOptions{
-		Zone:    "zone",
-		Region:  "region",
-		Project: "project",
+func readTestDataFrame(t *testing.T, r io.Reader) []byte {
+	header := make([]byte, 6)
+	_, err := io.ReadFull(r, header)
+	assert.NoError(t, err)
+	assert.Equal(t, subprotoTagData, binary.BigEndian.Uint16(header[0:2]))
+
+	buf := make([]byte, binary.BigEndian.Uint32(header[2:6]))
+	_, err = io.ReadFull(r, buf)
+	assert.NoError(t, err)
+
+	return buf
+}
+
+// failingConn fails every write after the first writes succeed.
+type failingConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *failingConn) Write(buf []byte) (int, error) {
+	if c.writes == 0 {
+		return 0, errors.New("write failed")
+	}
+	c.writes--
+	return c.Conn.Write(buf)
+}
+
+func TestWrite(t *testing.T) {
+	t.Run("Without coalescing", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r)
+		defer conn.Close()
+
+		go func() {
+			conn.Write([]byte("a"))
+			conn.Write([]byte("b"))
+		}()
+
+		assert.Equal(t, []byte("a"), readTestDataFrame(t, w))
+		assert.Equal(t, []byte("b"), readTestDataFrame(t, w))
 	})
 
-	assert.Contains(t, url, proxyHost)
-	assert.Contains(t, url, proxyPath)
+	t.Run("With concurrent writers", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
 
-	assert.Contains(t, url, "zone=zone")
-	assert.Contains(t, url, "region=region")
-	assert.Contains(t, url, "project=project")
+		conn := NewConn(r)
+		defer conn.Close()
 
-	assert.NotContains(t, url, "token=")
-	assert.NotContains(t, url, "group=")
-	assert.NotContains(t, url, "port=")
+		const writers = 8
+		const writes = 16
+
+		for i := 0; i < writers; i++ {
+			go func(b byte) {
+				buf := bytes.Repeat([]byte{b}, 64)
+				for j := 0; j < writes; j++ {
+					n, err := conn.Write(buf)
+					assert.NoError(t, err)
+					assert.Equal(t, len(buf), n)
+				}
+			}(byte('a' + i))
+		}
+
+		for i := 0; i < writers*writes; i++ {
+			buf := readTestDataFrame(t, w)
+			assert.Len(t, buf, 64)
+			assert.Equal(t, bytes.Repeat(buf[:1], 64), buf)
+		}
+	})
+
+	t.Run("With coalesced writes of varying sizes", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r, WithWriteCoalesce(time.Hour), WithWriteCoalesceThreshold(100))
+		defer conn.Close()
+
+		// writes of every size up to 40 bytes straddle the frame boundaries
+		var expected []byte
+		for size := 1; size <= 40; size++ {
+			expected = append(expected, bytes.Repeat([]byte{byte('a' + size%26)}, size)...)
+		}
+
+		go func() {
+			for size, buf := 1, expected; len(buf) > 0; size++ {
+				n, err := conn.Write(buf[:size])
+				assert.NoError(t, err)
+				assert.Equal(t, size, n)
+				buf = buf[size:]
+			}
+			conn.Flush()
+		}()
+
+		var received []byte
+		for len(received) < len(expected) {
+			received = append(received, readTestDataFrame(t, w)...)
+		}
+		assert.Equal(t, expected, received)
+	})
+
+	t.Run("With failing frame", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		go io.Copy(io.Discard, w)
+
+		conn := NewConn(&failingConn{Conn: r, writes: 1})
+		defer conn.Close()
+
+		// the first batch of frames goes out in one write, the rest fail
+		n, err := conn.Write(make([]byte, (subprotoMaxBatchFrames+1)*subprotoMaxFrameSize+10))
+		assert.Error(t, err)
+		assert.Equal(t, subprotoMaxBatchFrames*subprotoMaxFrameSize, n)
+	})
+
+	t.Run("With batched frames", func(t *testing.T) {
+		pipe := func() (net.Conn, net.Conn) {
+			return net.Pipe()
+		}
+		tcp := func() (net.Conn, net.Conn) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			r, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return r, w
+		}
+
+		for name, connPair := range map[string]func() (net.Conn, net.Conn){"Pipe": pipe, "TCP": tcp} {
+			t.Run(name, func(t *testing.T) {
+				r, w := connPair()
+				defer w.Close()
+
+				conn := NewConn(r)
+				defer conn.Close()
+
+				buf := make([]byte, (subprotoMaxBatchFrames+1)*subprotoMaxFrameSize+10)
+				for i := range buf {
+					buf[i] = byte(i % 251)
+				}
+
+				go func() {
+					n, err := conn.Write(buf)
+					assert.NoError(t, err)
+					assert.Equal(t, len(buf), n)
+				}()
+
+				var received []byte
+				for len(received) < len(buf) {
+					frame := readTestDataFrame(t, w)
+					assert.LessOrEqual(t, len(frame), subprotoMaxFrameSize)
+					received = append(received, frame...)
+				}
+				assert.Equal(t, buf, received)
+			})
+		}
+	})
+
+	t.Run("With batched retained frames", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		counting := &countingConn{Conn: r}
+		conn := NewConn(counting, WithReconnect())
+		defer conn.Close()
+
+		buf := make([]byte, 2*subprotoMaxBatchFrames*subprotoMaxFrameSize)
+		rand.Read(buf)
+
+		go func() {
+			n, err := conn.Write(buf)
+			assert.NoError(t, err)
+			assert.Equal(t, len(buf), n)
+		}()
+
+		var received []byte
+		for len(received) < len(buf) {
+			received = append(received, readTestDataFrame(t, w)...)
+		}
+		assert.Equal(t, buf, received)
+
+		// each batch of frames is sent as a single message
+		assert.Equal(t, int64(2), counting.writes.Load())
+	})
+
+	t.Run("With initial data", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		initialData := bytes.Repeat([]byte("x"), subprotoMaxFrameSize+1)
+
+		conn := NewConn(r, WithInitialData(initialData))
+		defer conn.Close()
+
+		// the write is queued behind the initial data however it's scheduled
+		// against the success frame
+		go conn.Write(testData)
+		w.Write(makeSuccessFrame(randomString()))
+
+		assert.Equal(t, initialData[:subprotoMaxFrameSize], readTestDataFrame(t, w))
+		assert.Equal(t, initialData[subprotoMaxFrameSize:], readTestDataFrame(t, w))
+		assert.Equal(t, testData, readTestDataFrame(t, w))
+	})
+
+	t.Run("With coalescing", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r, WithWriteCoalesce(10*time.Millisecond))
+		defer conn.Close()
+
+		go func() {
+			conn.Write([]byte("a"))
+			conn.Write([]byte("b"))
+			conn.Write([]byte("c"))
+		}()
+
+		assert.Equal(t, []byte("abc"), readTestDataFrame(t, w))
+	})
+
+	t.Run("With coalescing and Flush", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r, WithWriteCoalesce(time.Hour))
+		defer conn.Close()
+
+		go func() {
+			conn.Write([]byte("a"))
+			conn.Write([]byte("b"))
+			assert.NoError(t, conn.Flush())
+		}()
+
+		assert.Equal(t, []byte("ab"), readTestDataFrame(t, w))
+	})
+
+	t.Run("With coalescing threshold", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r, WithWriteCoalesce(time.Hour), WithWriteCoalesceThreshold(2))
+		defer conn.Close()
+
+		go func() {
+			conn.Write([]byte("a"))
+			conn.Write([]byte("b"))
+		}()
+
+		assert.Equal(t, []byte("ab"), readTestDataFrame(t, w))
+	})
+}
+
+// pipeDialer returns a dialer that connects to the returned relay end of a pipe.
+func pipeDialer() (websocketDialer, net.Conn) {
+	client, relay := net.Pipe()
+
+	return func(context.Context, string, *websocket.DialOptions) (net.Conn, *http.Response, error) {
+		resp := &http.Response{
+			StatusCode: http.StatusSwitchingProtocols,
+			Header:     http.Header{"X-Goog-Test": []string{"relay"}},
+		}
+		return client, resp, nil
+	}, relay
+}
+
+func TestDialer(t *testing.T) {
+	dialer, relay := pipeDialer()
+	defer relay.Close()
+
+	sessionID := randomString()
+
+	go func() {
+		relay.Write(makeSuccessFrame(sessionID))
+		relay.Write(makeDataFrame(testData))
+
+		buf := readTestDataFrame(t, relay)
+		relay.Write(makeAckFrame(uint64(len(buf))))
+	}()
+
+	conn, err := dial(context.Background(), "ws://relay", withDialer(dialer))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	buf := make([]byte, len(testData))
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, testData, buf)
+
+	assert.True(t, conn.Connected())
+	assert.Equal(t, sessionID, conn.SessionID())
+
+	resp := conn.HandshakeResponse()
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "relay", resp.Header.Get("X-Goog-Test"))
+	assert.Equal(t, http.NoBody, resp.Body)
+
+	_, err = conn.Write([]byte("ping"))
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return conn.Sent() == uint64(len("ping"))
+	}, time.Second, time.Millisecond)
+}
+
+func TestBackend(t *testing.T) {
+	dialer, relay := pipeDialer()
+	defer relay.Close()
+
+	conn, err := dial(context.Background(), "ws://relay", withDialer(dialer), WithBackendHeader("X-Goog-Test"))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, "relay", conn.Backend())
+	assert.Equal(t, "relay", conn.Stats().Backend)
+
+	t.Run("Without header", func(t *testing.T) {
+		dialer, relay := pipeDialer()
+		defer relay.Close()
+
+		conn, err := dial(context.Background(), "ws://relay", withDialer(dialer), WithBackendHeader("X-Goog-Backend"))
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		assert.Empty(t, conn.Backend())
+	})
+}
+
+func TestCloseWrite(t *testing.T) {
+	r, w := net.Pipe()
+	defer w.Close()
+
+	conn := NewConn(r)
+	defer conn.Close()
+
+	w.Write(makeSuccessFrame(randomString()))
+	assert.ErrorIs(t, conn.CloseWrite(), errors.ErrUnsupported)
+
+	// the connection is left open both ways
+	go conn.Write(testData)
+	assert.Equal(t, testData, readTestDataFrame(t, w))
+
+	go w.Write(makeDataFrame(testData))
+	buf := make([]byte, len(testData))
+	_, err := io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, testData, buf)
+	assert.False(t, conn.IsClosed())
+}
+
+func TestMeteredConn(t *testing.T) {
+	r, w := net.Pipe()
+
+	conn := NewConn(r)
+	defer conn.Close()
+
+	m := NewMeteredConn(conn)
+	assert.True(t, m.LastActivity().IsZero())
+
+	w.Write(makeSuccessFrame(randomString()))
+
+	received := make(chan int, 1)
+	go func() {
+		var n int
+		for {
+			frame, err := decodeFrame(w, subprotoMaxFrameSize)
+			if err != nil {
+				received <- n
+				return
+			}
+			n += len(frame.Payload)
+		}
+	}()
+
+	_, err := m.Write([]byte("ping"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), m.BytesWritten())
+	assert.False(t, m.LastActivity().IsZero())
+
+	// io.Copy goes through ReadFrom when the reader has no WriteTo
+	_, err = io.Copy(m, struct{ io.Reader }{bytes.NewReader(make([]byte, 100*1024))})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4+100*1024), m.BytesWritten())
+
+	go func() {
+		w.Write(makeDataFrame(testData))
+		w.Write(makeDataFrame(make([]byte, 1000)))
+	}()
+
+	buf := make([]byte, len(testData))
+	_, err = io.ReadFull(m, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(len(testData)), m.BytesRead())
+
+	// and through WriteTo until the relay closes
+	var out bytes.Buffer
+	go func() {
+		assert.Eventually(t, func() bool {
+			return m.BytesRead() == uint64(len(testData)+1000)
+		}, time.Second, time.Millisecond)
+		w.Close()
+	}()
+	io.Copy(&out, m)
+	assert.Equal(t, 1000, out.Len())
+
+	assert.Equal(t, 4+100*1024, <-received)
+}
+
+func TestMeteredConnShortWrite(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	m := NewMeteredConn(shortConn{a})
+	defer m.Close()
+
+	// only the bytes the wrapped conn wrote are counted
+	n, err := m.ReadFrom(bytes.NewReader(make([]byte, 100)))
+	assert.ErrorIs(t, err, io.ErrShortWrite)
+	assert.EqualValues(t, 3, n)
+	assert.Equal(t, uint64(3), m.BytesWritten())
+}
+
+func TestMeteredConnRateLimit(t *testing.T) {
+	// newLimited returns a MeteredConn limited to 1000 bytes per second by a fake
+	// clock, and the other end of the conn it wraps
+	newLimited := func(t *testing.T) (*MeteredConn, net.Conn, *fakeClock) {
+		a, b := net.Pipe()
+		t.Cleanup(func() { b.Close() })
+
+		clock := newFakeClock()
+		m := NewMeteredConn(a)
+		m.clock = clock
+		m.SetRateLimit(1000)
+		t.Cleanup(func() { m.Close() })
+		return m, b, clock
+	}
+
+	t.Run("Write", func(t *testing.T) {
+		m, b, clock := newLimited(t)
+		go io.Copy(io.Discard, b)
+
+		done := make(chan int, 1)
+		go func() {
+			n, err := m.Write(make([]byte, 2500))
+			assert.NoError(t, err)
+			done <- n
+		}()
+
+		// a burst goes at once, and the rest as the limit allows
+		for _, step := range []struct {
+			written uint64
+			wait    time.Duration
+		}{{1000, time.Second}, {2000, 500 * time.Millisecond}} {
+			assert.Eventually(t, func() bool {
+				return m.BytesWritten() == step.written && clock.waiting() == 1
+			}, time.Second, time.Millisecond)
+			clock.advance(step.wait)
+		}
+
+		select {
+		case n := <-done:
+			assert.Equal(t, 2500, n)
+		case <-time.After(time.Second):
+			t.Fatal("Write didn't return")
+		}
+		assert.Equal(t, uint64(2500), m.BytesWritten())
+	})
+
+	t.Run("Read", func(t *testing.T) {
+		m, b, clock := newLimited(t)
+		go b.Write(make([]byte, 1500))
+
+		// reads are capped to a burst
+		buf := make([]byte, 2000)
+		n, err := m.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, 1000, n)
+
+		done := make(chan int, 1)
+		go func() {
+			n, err := m.Read(buf)
+			assert.NoError(t, err)
+			done <- n
+		}()
+
+		assert.Eventually(t, func() bool {
+			return clock.waiting() == 1
+		}, time.Second, time.Millisecond)
+		clock.advance(500 * time.Millisecond)
+
+		select {
+		case n := <-done:
+			assert.Equal(t, 500, n)
+		case <-time.After(time.Second):
+			t.Fatal("Read didn't return")
+		}
+	})
+
+	t.Run("Deadline", func(t *testing.T) {
+		m, b, _ := newLimited(t)
+		go io.Copy(io.Discard, b)
+
+		// the second burst would have to wait past the deadline
+		m.SetWriteDeadline(time.Now().Add(500 * time.Millisecond))
+		n, err := m.Write(make([]byte, 2000))
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+		assert.Equal(t, 1000, n)
+	})
+
+	t.Run("Removed", func(t *testing.T) {
+		m, b, _ := newLimited(t)
+		go io.Copy(io.Discard, b)
+
+		m.SetRateLimit(0)
+		n, err := m.Write(make([]byte, 2500))
+		assert.NoError(t, err)
+		assert.Equal(t, 2500, n)
+	})
+}
+
+func TestIsClosed(t *testing.T) {
+	t.Run("Relay closes", func(t *testing.T) {
+		r, w := net.Pipe()
+
+		conn := NewConn(r)
+		defer conn.Close()
+
+		assert.False(t, conn.Connected())
+		assert.False(t, conn.IsClosed())
+
+		w.Write(makeSuccessFrame(randomString()))
+		assert.Eventually(t, conn.Connected, time.Second, time.Millisecond)
+		assert.False(t, conn.IsClosed())
+
+		w.Close()
+		assert.Eventually(t, conn.IsClosed, time.Second, time.Millisecond)
+		assert.False(t, conn.Connected())
+		assert.Error(t, conn.Err())
+		assert.Eventually(t, func() bool {
+			return isClosedChan(conn.Done())
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r)
+		w.Write(makeSuccessFrame(randomString()))
+		assert.Eventually(t, conn.Connected, time.Second, time.Millisecond)
+
+		conn.Close()
+		assert.True(t, conn.IsClosed())
+		assert.False(t, conn.Connected())
+	})
+
+	t.Run("Closed before connecting", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r)
+		assert.False(t, isClosedChan(conn.Done()))
+		conn.Close()
+		assert.True(t, conn.IsClosed())
+		assert.False(t, conn.Connected())
+		assert.True(t, isClosedChan(conn.Done()))
+	})
+}
+
+func TestWaitConnected(t *testing.T) {
+	t.Run("Ready", func(t *testing.T) {
+		pipe, relay := pipeDialer()
+		defer relay.Close()
+
+		// the relay only connects once the handshake is done, so dial has to wait
+		dialed := make(chan struct{})
+		dialer := func(ctx context.Context, url string, wsOptions *websocket.DialOptions) (net.Conn, *http.Response, error) {
+			defer close(dialed)
+			return pipe(ctx, url, wsOptions)
+		}
+
+		go func() {
+			<-dialed
+			relay.Write(makeSuccessFrame(randomString()))
+			io.Copy(io.Discard, relay)
+		}()
+
+		conn, err := dial(context.Background(), "ws://relay", withDialer(dialer), WithWaitConnected(time.Second))
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		assert.True(t, conn.Connected())
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		dialer, relay := pipeDialer()
+		defer relay.Close()
+
+		_, err := dial(context.Background(), "ws://relay", withDialer(dialer), WithWaitConnected(20*time.Millisecond))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		// the connection to the relay is closed
+		_, err = relay.Read(make([]byte, 1))
+		assert.Error(t, err)
+	})
+
+	t.Run("Parent context", func(t *testing.T) {
+		dialer, relay := pipeDialer()
+		defer relay.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err := dial(ctx, "ws://relay", withDialer(dialer), WithWaitConnected(time.Minute))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+}
+
+func TestOnConnect(t *testing.T) {
+	r, w := net.Pipe()
+	defer w.Close()
+
+	var sessionIDs []string
+	conn := NewConn(r, WithOnConnect(func(sessionID string) {
+		sessionIDs = append(sessionIDs, sessionID)
+	}))
+	defer conn.Close()
+
+	sessionID := randomString()
+
+	go func() {
+		w.Write(makeSuccessFrame(sessionID))
+		w.Write(makeDataFrame(testData))
+		w.Write(makeDataFrame(testData))
+	}()
+
+	buf := make([]byte, 2*len(testData))
+	_, err := io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{sessionID}, sessionIDs)
+}
+
+func TestPing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wsConn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			Subprotocols: []string{proxySubproto},
+		})
+		if err != nil {
+			panic(err)
+		}
+		defer wsConn.CloseNow()
+
+		wsConn.Write(r.Context(), websocket.MessageBinary, makeSuccessFrame(randomString()))
+
+		// reading answers pings until the client goes away
+		<-wsConn.CloseRead(r.Context()).Done()
+	}))
+	defer server.Close()
+
+	conn, err := dial(context.Background(), "ws://"+server.Listener.Addr().String(), WithFrameCapture(io.Discard))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	rtt, err := conn.Ping(ctx)
+	assert.NoError(t, err)
+	assert.Greater(t, rtt, time.Duration(0))
+	assert.Less(t, rtt, time.Second)
+
+	t.Run("Without WebSocket", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r)
+		defer conn.Close()
+
+		_, err := conn.Ping(context.Background())
+		assert.ErrorIs(t, err, errors.ErrUnsupported)
+	})
+}
+
+// pingConn answers each ping with the next result from pongs.
+type pingConn struct {
+	net.Conn
+	pongs chan error
+}
+
+func (c *pingConn) Ping(ctx context.Context) error {
+	select {
+	case err := <-c.pongs:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	r, w := net.Pipe()
+	defer w.Close()
+
+	pongs := make(chan error)
+	conn := NewConn(&pingConn{r, pongs}, WithKeepAlive(50*time.Millisecond), WithKeepAliveMissedLimit(1))
+	defer conn.Close()
+
+	pong := func(err error) {
+		select {
+		case pongs <- err:
+		case <-time.After(time.Second):
+			t.Fatal("keepalive didn't ping")
+		}
+	}
+
+	// one missed pong is tolerated, and a pong resets the count
+	pong(errors.New("lost"))
+	pong(nil)
+	pong(errors.New("lost"))
+	pong(nil)
+	assert.NoError(t, conn.Err())
+
+	// so is a missed pong followed by received data
+	pong(errors.New("lost"))
+	w.Write(makeSuccessFrame(randomString()))
+	go w.Write(makeDataFrame(testData))
+	_, err := io.ReadFull(conn, make([]byte, len(testData)))
+	assert.NoError(t, err)
+	pong(errors.New("lost"))
+	assert.NoError(t, conn.Err())
+
+	// but not a second one in a row
+	pong(errors.New("lost"))
+	assert.Eventually(t, func() bool {
+		return conn.Err() != nil
+	}, time.Second, time.Millisecond)
+	assert.ErrorIs(t, conn.Err(), ErrKeepAliveTimeout)
+	assert.Equal(t, CloseReasonKeepAlive, conn.Stats().CloseReason)
+}
+
+func TestCorrelationID(t *testing.T) {
+	r, w := net.Pipe()
+	defer w.Close()
+
+	conn := NewConn(r, WithCorrelationID("req-123"))
+	defer conn.Close()
+
+	assert.Equal(t, "req-123", conn.CorrelationID())
+}
+
+type expiringTokenSource struct {
+	n int
+}
+
+func (s *expiringTokenSource) Token() (*oauth2.Token, error) {
+	s.n++
+	return &oauth2.Token{
+		AccessToken: fmt.Sprintf("token-%d", s.n),
+		Expiry:      time.Now(),
+	}, nil
+}
+
+func TestDialCancel(t *testing.T) {
+	t.Run("During handshake", func(t *testing.T) {
+		goroutines := runtime.NumGoroutine()
+
+		r, w := net.Pipe()
+		defer w.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		// the dialer leaves a half-open conn behind when canceled
+		dialer := func(ctx context.Context, url string, wsOptions *websocket.DialOptions) (net.Conn, *http.Response, error) {
+			cancel()
+			<-ctx.Done()
+			return r, nil, errors.New("handshake interrupted")
+		}
+
+		_, err := dial(ctx, "ws://relay", withDialer(dialer))
+		assert.ErrorIs(t, err, context.Canceled)
+
+		_, err = w.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+
+		// dial cleans up before it returns, so nothing is left running
+		assert.LessOrEqual(t, runtime.NumGoroutine(), goroutines)
+	})
+
+	t.Run("After handshake", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		dialer := func(ctx context.Context, url string, wsOptions *websocket.DialOptions) (net.Conn, *http.Response, error) {
+			cancel()
+			return r, &http.Response{StatusCode: http.StatusSwitchingProtocols}, nil
+		}
+
+		conn, err := dial(ctx, "ws://relay", withDialer(dialer))
+		assert.Nil(t, conn)
+		assert.ErrorIs(t, err, context.Canceled)
+
+		_, err = w.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
+
+func TestRawFrames(t *testing.T) {
+	dialer, relay := pipeDialer()
+	defer relay.Close()
+
+	sessionID := randomString()
+	acked := make(chan []byte, 1)
+
+	go func() {
+		relay.Write(makeSuccessFrame(sessionID))
+		relay.Write(makeDataFrame(testData))
+
+		ack := make([]byte, 10)
+		io.ReadFull(relay, ack)
+		acked <- ack
+
+		readTestDataFrame(t, relay)
+		relay.Write(makeAckFrame(uint64(len(testData))))
+	}()
+
+	conn, err := dial(context.Background(), "ws://relay", withDialer(dialer), WithRawFrames())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	frame, err := conn.NextFrame(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, Frame{FrameTagSuccess, []byte(sessionID)}, frame)
+	assert.Equal(t, sessionID, conn.SessionID())
+
+	frame, err = conn.NextFrame(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, Frame{FrameTagData, testData}, frame)
+
+	// data is only acked when asked to
+	assert.NoError(t, conn.Ack())
+	assert.Equal(t, makeAckFrame(uint64(len(testData))), <-acked)
+
+	_, err = conn.Write(testData)
+	assert.NoError(t, err)
+
+	frame, err = conn.NextFrame(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, Frame{FrameTagAck, binary.BigEndian.AppendUint64(nil, uint64(len(testData)))}, frame)
+
+	var configError *ConfigError
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorAs(t, err, &configError)
+
+	t.Run("Without raw frames", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r)
+		defer conn.Close()
+
+		_, err := conn.NextFrame(context.Background())
+		assert.ErrorAs(t, err, &configError)
+	})
+}
+
+func TestFrameCapture(t *testing.T) {
+	r, w := net.Pipe()
+	defer w.Close()
+
+	var capture bytes.Buffer
+	conn := NewConn(r, WithFrameCapture(&capture))
+
+	sessionID := randomString()
+	large := bytes.Repeat([]byte("x"), 10000)
+
+	go func() {
+		w.Write(makeSuccessFrame(sessionID))
+		w.Write(makeDataFrame(testData))
+		w.Write(makeDataFrame(large))
+	}()
+
+	buf := make([]byte, len(testData)+len(large))
+	_, err := io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+
+	go func() {
+		readTestDataFrame(t, w)
+		w.Write(makeAckFrame(4))
+	}()
+	_, err = conn.Write([]byte("ping"))
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return conn.Sent() == 4
+	}, time.Second, time.Millisecond)
+	conn.Close()
+
+	// the read and write loops record independently, so only the order within
+	// each direction is meaningful
+	frames := map[Direction][]Frame{}
+
+	err = ReplayFrames(&capture, func(dir Direction, frame Frame) error {
+		frames[dir] = append(frames[dir], frame)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []Frame{
+		{FrameTagSuccess, []byte(sessionID)},
+		{FrameTagData, testData},
+		{FrameTagData, large},
+		{FrameTagAck, makeAckFrame(4)[2:]},
+	}, frames[DirectionReceived])
+	assert.Equal(t, []Frame{
+		{FrameTagData, []byte("ping")},
+	}, frames[DirectionSent])
+
+	t.Run("Truncated", func(t *testing.T) {
+		var capture bytes.Buffer
+		(&frameCapture{w: &capture}).record(DirectionReceived, makeDataFrame(testData)[:4])
+
+		err := ReplayFrames(&capture, func(Direction, Frame) error {
+			return nil
+		})
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+
+	t.Run("Split", func(t *testing.T) {
+		var capture bytes.Buffer
+		data := make([]byte, maxCaptureRecordSize)
+		(&frameCapture{w: &capture}).record(DirectionSent, appendDataFrames(nil, data))
+
+		var received []byte
+		err := ReplayFrames(&capture, func(dir Direction, frame Frame) error {
+			received = append(received, frame.Payload...)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, data, received)
+	})
+
+	t.Run("Corrupt length", func(t *testing.T) {
+		capture := bytes.NewReader([]byte{byte(DirectionReceived), 0xff, 0xff, 0xff, 0xff})
+
+		err := ReplayFrames(capture, func(Direction, Frame) error {
+			return nil
+		})
+		var protocolError *ProtocolError
+		assert.ErrorAs(t, err, &protocolError)
+	})
+}
+
+func TestTranscript(t *testing.T) {
+	sessionID := randomString()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wsConn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			Subprotocols: []string{proxySubproto},
+		})
+		if err != nil {
+			panic(err)
+		}
+		defer wsConn.CloseNow()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+
+		conn := websocket.NetConn(ctx, wsConn, websocket.MessageBinary)
+		conn.Write(makeSuccessFrame(sessionID))
+		conn.Write(makeDataFrame(testData))
+		readTestDataFrame(t, conn)
+		wsConn.Close(websocket.StatusNormalClosure, "")
+	}))
+	defer server.Close()
+
+	tokenSource := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "secret-token", TokenType: "Bearer"})
+
+	var transcript bytes.Buffer
+	conn, err := dial(context.Background(), "ws://"+server.Listener.Addr().String(), WithTokenSource(&tokenSource), WithTranscript(&transcript))
+	assert.NoError(t, err)
+
+	buf := make([]byte, len(testData))
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	_, err = conn.Write(testData)
+	assert.NoError(t, err)
+	_, err = conn.Read(buf)
+	assert.ErrorIs(t, err, io.EOF)
+	conn.Close()
+
+	raw := transcript.String()
+	assert.NotContains(t, raw, "secret-token")
+	assert.NotContains(t, raw, sessionID)
+
+	var events []map[string]any
+	var names []any
+	for dec := json.NewDecoder(&transcript); dec.More(); {
+		var event map[string]any
+		assert.NoError(t, dec.Decode(&event))
+		events = append(events, event)
+		names = append(names, event["event"])
+	}
+	assert.Equal(t, []any{"dial", "open", "connected", "close"}, names)
+
+	dial := events[0]
+	assert.Equal(t, "ws://"+server.Listener.Addr().String(), dial["url"])
+	assert.Equal(t, []any{"Bearer REDACTED"}, dial["header"].(map[string]any)["Authorization"])
+	assert.EqualValues(t, http.StatusSwitchingProtocols, dial["status"])
+
+	close := events[3]
+	assert.Equal(t, "eof", close["reason"])
+	assert.Equal(t, map[string]any{
+		"received": map[string]any{"success": 1.0, "data": 1.0},
+		"sent":     map[string]any{"data": 1.0},
+	}, close["frames"])
+}
+
+func TestRemoteAddr(t *testing.T) {
+	tests := []struct {
+		opts []DialOption
+		addr string
+	}{
+		{[]DialOption{WithInstance("my-instance", "us-central1-a", "nic0"), WithPort("22")}, "my-instance:22"},
+		{[]DialOption{WithHost("10.0.0.1", "us-central1", "default", "group"), WithPort("80")}, "10.0.0.1:80"},
+		{[]DialOption{WithHost("fd00::1", "us-central1", "default", "group"), WithPort("80")}, "[fd00::1]:80"},
+	}
+
+	for _, test := range tests {
+		dialer, relay := pipeDialer()
+		defer relay.Close()
+
+		conn, err := dial(context.Background(), "ws://relay", append(test.opts, withDialer(dialer))...)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		assert.Equal(t, "iap", conn.RemoteAddr().Network())
+		assert.Equal(t, test.addr, conn.RemoteAddr().String())
+	}
+}
+
+func TestRelayAddr(t *testing.T) {
+	t.Run("Host", func(t *testing.T) {
+		hosts := make(chan string, 1)
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hosts <- r.Host
+			wsUpgradeHandler(w, r)
+		}))
+		defer server.Close()
+
+		_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+		relayURL := "ws://" + net.JoinHostPort(proxyHost, port) + connectPath(defaultProtocolVersion)
+
+		conn, err := dial(context.Background(), relayURL, WithRelayAddr("127.0.0.1"))
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		assert.Equal(t, net.JoinHostPort(proxyHost, port), <-hosts)
+	})
+
+	t.Run("SNI", func(t *testing.T) {
+		serverNames := make(chan string, 1)
+
+		server := httptest.NewUnstartedServer(http.HandlerFunc(wsUpgradeHandler))
+		server.TLS = &tls.Config{
+			GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				serverNames <- hello.ServerName
+				return nil, nil
+			},
+		}
+		server.StartTLS()
+		defer server.Close()
+
+		// the test certificate isn't trusted so the handshake fails after the hello
+		_, err := dial(context.Background(), "wss://"+proxyHost+connectPath(defaultProtocolVersion), WithRelayAddr(server.Listener.Addr().String()))
+		assert.Error(t, err)
+
+		assert.Equal(t, proxyHost, <-serverNames)
+	})
+}
+
+func TestRelayHosts(t *testing.T) {
+	refused := errors.New("refused")
+	opts := []DialOption{WithProject("my-proj"), WithInstance("my-instance", "us-central1-a", "nic0")}
+
+	t.Run("Failover", func(t *testing.T) {
+		client, relay := net.Pipe()
+		defer relay.Close()
+
+		var hosts []string
+		dialer := func(ctx context.Context, rawURL string, wsOptions *websocket.DialOptions) (net.Conn, *http.Response, error) {
+			u, _ := url.Parse(rawURL)
+			hosts = append(hosts, u.Host)
+			if u.Host == "relay-a.example.com" {
+				return nil, nil, refused
+			}
+			return client, &http.Response{StatusCode: http.StatusSwitchingProtocols}, nil
+		}
+
+		conn, err := Dial(context.Background(), append(opts, withDialer(dialer), WithRelayHosts([]string{"relay-a.example.com", "relay-b.example.com"}))...)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		assert.Equal(t, []string{"relay-a.example.com", "relay-b.example.com"}, hosts)
+		assert.Contains(t, conn.url, "relay-b.example.com")
+	})
+
+	t.Run("All fail", func(t *testing.T) {
+		dialer := func(context.Context, string, *websocket.DialOptions) (net.Conn, *http.Response, error) {
+			return nil, nil, refused
+		}
+
+		_, err := Dial(context.Background(), append(opts, withDialer(dialer), WithRelayHosts([]string{"relay-a.example.com", "relay-b.example.com"}))...)
+		assert.ErrorIs(t, err, refused)
+		assert.ErrorContains(t, err, "relay-a.example.com")
+		assert.ErrorContains(t, err, "relay-b.example.com")
+	})
+
+	t.Run("With relay address", func(t *testing.T) {
+		_, err := Dial(context.Background(), append(opts, WithRelayHosts([]string{"relay-a.example.com"}), WithRelayAddr("10.0.0.1"))...)
+		var configError *ConfigError
+		assert.ErrorAs(t, err, &configError)
+	})
+}
+
+func TestHostHeader(t *testing.T) {
+	t.Run("Override", func(t *testing.T) {
+		hosts := make(chan string, 1)
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hosts <- r.Host
+			wsUpgradeHandler(w, r)
+		}))
+		defer server.Close()
+
+		relayURL := "ws://" + server.Listener.Addr().String() + connectPath(defaultProtocolVersion)
+
+		conn, err := dial(context.Background(), relayURL, WithHostHeader(proxyHost))
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		assert.Equal(t, proxyHost, <-hosts)
+	})
+
+	tests := []struct {
+		host string
+		ok   bool
+	}{
+		{"tunnel.cloudproxy.app", true},
+		{"tunnel.cloudproxy.app:443", true},
+		{"10.0.0.1", true},
+		{"[::1]", true},
+		{"[::1]:8443", true},
+		{"::1", false},
+		{"tunnel.cloudproxy.app:0", false},
+		{"tunnel cloudproxy.app", false},
+		{"tunnel.cloudproxy.app/path", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.host, func(t *testing.T) {
+			dopts := &dialOptions{}
+			dopts.collectOpts([]DialOption{WithHostHeader(test.host)})
+
+			err := dopts.validate()
+			if test.ok {
+				assert.NoError(t, err)
+			} else {
+				var configError *ConfigError
+				assert.ErrorAs(t, err, &configError)
+			}
+		})
+	}
+}
+
+func TestDialTrace(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(wsUpgradeHandler))
+	defer server.Close()
+
+	relayURL := "ws://" + server.Listener.Addr().String() + connectPath(defaultProtocolVersion)
+
+	var (
+		mu     sync.Mutex
+		phases []string
+	)
+	phase := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		phases = append(phases, name)
+	}
+
+	trace := &httptrace.ClientTrace{
+		ConnectStart:         func(network, addr string) { phase("connect start") },
+		ConnectDone:          func(network, addr string, err error) { phase("connect done") },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { phase("wrote request") },
+		GotFirstResponseByte: func() { phase("first response byte") },
+	}
+
+	conn, err := dial(context.Background(), relayURL, WithDialTrace(trace))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"connect start", "connect done", "wrote request", "first response byte"}, phases)
+}
+
+func TestTCPNoDelay(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(wsUpgradeHandler))
+	defer server.Close()
+
+	noDelays := make(chan bool, 1)
+	defer func(orig func(*net.TCPConn, bool) error) { setNoDelay = orig }(setNoDelay)
+	setNoDelay = func(conn *net.TCPConn, noDelay bool) error {
+		noDelays <- noDelay
+		return conn.SetNoDelay(noDelay)
+	}
+
+	relayURL := "ws://" + server.Listener.Addr().String() + connectPath(defaultProtocolVersion)
+
+	conn, err := dial(context.Background(), relayURL, WithTCPNoDelay(false))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	assert.False(t, <-noDelays)
+
+	// without the option the connection keeps Go's default
+	conn, err = dial(context.Background(), relayURL)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	assert.Empty(t, noDelays)
+}
+
+func TestTrafficClass(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(wsUpgradeHandler))
+	defer server.Close()
+
+	type call struct {
+		network string
+		tos     int
+	}
+	calls := make(chan call, 1)
+	defer func(orig func(string, syscall.RawConn, int) error) { setTrafficClass = orig }(setTrafficClass)
+	setTrafficClass = func(network string, c syscall.RawConn, tos int) error {
+		calls <- call{network, tos}
+		return setSockTrafficClass(network, c, tos)
+	}
+
+	relayURL := "ws://" + server.Listener.Addr().String() + connectPath(defaultProtocolVersion)
+
+	conn, err := dial(context.Background(), relayURL, WithTrafficClass(0xb8))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, call{"tcp4", 0xb8}, <-calls)
+
+	for _, tos := range []int{-1, 256} {
+		_, err := Dial(context.Background(), WithTrafficClass(tos))
+		var configError *ConfigError
+		assert.ErrorAs(t, err, &configError)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(wsUpgradeHandler))
+	defer server.Close()
+
+	relayURL := "wss://" + server.Listener.Addr().String()
+
+	t.Run("Trusted", func(t *testing.T) {
+		roots := x509.NewCertPool()
+		roots.AddCert(server.Certificate())
+
+		conn, err := dial(context.Background(), relayURL, WithTLSConfig(&tls.Config{RootCAs: roots}))
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		buf := make([]byte, len(testData))
+		_, err = io.ReadFull(conn, buf)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Untrusted", func(t *testing.T) {
+		_, err := dial(context.Background(), relayURL, WithTLSConfig(&tls.Config{RootCAs: x509.NewCertPool()}))
+
+		var certError *tls.CertificateVerificationError
+		assert.ErrorAs(t, err, &certError)
+	})
+}
+
+func TestHTTPProxy(t *testing.T) {
+	relay := httptest.NewTLSServer(http.HandlerFunc(wsUpgradeHandler))
+	defer relay.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(relay.Certificate())
+
+	type connect struct {
+		target string
+		auth   string
+	}
+	connects := make(chan connect, 1)
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		connects <- connect{r.Host, r.Header.Get("Proxy-Authorization")}
+
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+
+		client, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			panic(err)
+		}
+		defer client.Close()
+
+		client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go io.Copy(upstream, client)
+		io.Copy(client, upstream)
+	}))
+	defer proxy.Close()
+
+	proxyURL := "http://user:password@" + proxy.Listener.Addr().String()
+	relayAddr := relay.Listener.Addr().String()
+
+	conn, err := dial(context.Background(), "wss://"+relayAddr,
+		WithHTTPProxy(proxyURL),
+		WithTLSConfig(&tls.Config{RootCAs: roots}),
+	)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	buf := make([]byte, len(testData))
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, testData, buf)
+
+	req := &http.Request{Header: http.Header{}}
+	req.SetBasicAuth("user", "password")
+	assert.Equal(t, connect{relayAddr, req.Header.Get("Authorization")}, <-connects)
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, opts := range [][]DialOption{
+			{WithHTTPProxy("://proxy")},
+			{WithHTTPProxy("proxy:3128")},
+			{WithHTTPProxy(proxyURL), WithRelayAddr("127.0.0.1")},
+		} {
+			dopts := &dialOptions{}
+			dopts.collectOpts(opts)
+
+			var configError *ConfigError
+			assert.ErrorAs(t, dopts.validate(), &configError)
+		}
+	})
+}
+
+func TestTokenSource(t *testing.T) {
+	var tokens []string
+	dialer := func(ctx context.Context, url string, wsOptions *websocket.DialOptions) (net.Conn, *http.Response, error) {
+		tokens = append(tokens, wsOptions.HTTPHeader.Get("Authorization"))
+		return nil, nil, errors.New("refused")
+	}
+
+	tokenSource := oauth2.ReuseTokenSource(nil, &expiringTokenSource{})
+
+	for i := 0; i < 2; i++ {
+		_, err := dial(context.Background(), "ws://relay", withDialer(dialer), WithTokenSource(&tokenSource))
+		assert.Error(t, err)
+	}
+
+	// the first token expired so the second dial must fetch a fresh one
+	assert.Equal(t, []string{"Bearer token-1", "Bearer token-2"}, tokens)
+}
+
+type countingTokenSource struct {
+	n int
+}
+
+func (s *countingTokenSource) Token() (*oauth2.Token, error) {
+	s.n++
+	return &oauth2.Token{
+		AccessToken: fmt.Sprintf("token-%d", s.n),
+		Expiry:      time.Now().Add(time.Hour),
+	}, nil
+}
+
+func TestNewDialer(t *testing.T) {
+	type handshake struct {
+		url    string
+		token  string
+		client *http.Client
+	}
+
+	var handshakes []handshake
+	dialer := func(ctx context.Context, url string, wsOptions *websocket.DialOptions) (net.Conn, *http.Response, error) {
+		handshakes = append(handshakes, handshake{url, wsOptions.HTTPHeader.Get("Authorization"), wsOptions.HTTPClient})
+		return nil, nil, errors.New("refused")
+	}
+
+	var tokenSource oauth2.TokenSource = &countingTokenSource{}
+	d := NewDialer(withDialer(dialer), WithTokenSource(&tokenSource), WithTLSConfig(&tls.Config{}), WithPort("22"))
+
+	_, err := d.Dial(context.Background())
+	assert.Error(t, err)
+	_, err = d.Dial(context.Background(), WithPort("80"))
+	assert.Error(t, err)
+	_, err = d.Dial(context.Background(), WithTLSConfig(&tls.Config{}))
+	assert.Error(t, err)
+
+	assert.Len(t, handshakes, 3)
+
+	// per-call options override the Dialer's
+	assert.Contains(t, handshakes[0].url, "port=22")
+	assert.Contains(t, handshakes[1].url, "port=80")
+
+	// the token is fetched once and reused
+	for _, h := range handshakes {
+		assert.Equal(t, "Bearer token-1", h.token)
+	}
+
+	// the HTTP client is shared unless a dial changes how the relay is reached
+	assert.NotNil(t, handshakes[0].client)
+	assert.Same(t, handshakes[0].client, handshakes[1].client)
+	assert.NotSame(t, handshakes[0].client, handshakes[2].client)
+}
+
+func TestProbe(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		dialer, relay := pipeDialer()
+		defer relay.Close()
+
+		go func() {
+			relay.Write(makeSuccessFrame(randomString()))
+			io.Copy(io.Discard, relay)
+		}()
+
+		assert.NoError(t, Probe(context.Background(), withDialer(dialer)))
+	})
+
+	t.Run("Forbidden", func(t *testing.T) {
+		dialer := func(context.Context, string, *websocket.DialOptions) (net.Conn, *http.Response, error) {
+			resp := &http.Response{StatusCode: http.StatusForbidden}
+			return nil, resp, errors.New("expected handshake response status code 101 but got 403")
+		}
+
+		err := Probe(context.Background(), withDialer(dialer))
+		assert.ErrorIs(t, err, ErrUnauthorized)
+
+		var handshakeError *HandshakeError
+		assert.ErrorAs(t, err, &handshakeError)
+		assert.Equal(t, http.StatusForbidden, handshakeError.StatusCode)
+	})
+}
+
+// relayDialer returns a dialer that creates a new pipe for every dial and
+// sends the relay end on the returned channel.
+func relayDialer() (websocketDialer, chan net.Conn) {
+	relays := make(chan net.Conn, 16)
+
+	return func(context.Context, string, *websocket.DialOptions) (net.Conn, *http.Response, error) {
+		client, relay := net.Pipe()
+		relays <- relay
+		return client, &http.Response{StatusCode: http.StatusSwitchingProtocols}, nil
+	}, relays
+}
+
+func TestListener(t *testing.T) {
+	dialer, relays := relayDialer()
+
+	l, err := Listen(context.Background(), 2, withDialer(dialer))
+	assert.NoError(t, err)
+
+	waiting := []net.Conn{<-relays, <-relays}
+	for _, relay := range waiting {
+		defer relay.Close()
+		relay.Write(makeSuccessFrame(randomString()))
+	}
+
+	// the destination initiates a connection by writing first
+	go waiting[1].Write(makeDataFrame([]byte("hello")))
+
+	conn, err := l.Accept()
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	buf := make([]byte, len("hello"))
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), buf)
+
+	go conn.Write([]byte("world"))
+	assert.Equal(t, []byte("world"), readTestDataFrame(t, waiting[1]))
+
+	// the accepted tunnel is replaced
+	replacement := <-relays
+	defer replacement.Close()
+
+	assert.NoError(t, l.Close())
+
+	_, err = l.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+
+	// accepted connections outlive the listener
+	go conn.Write([]byte("!"))
+	assert.Equal(t, []byte("!"), readTestDataFrame(t, waiting[1]))
+}
+
+func TestReconnect(t *testing.T) {
+	sessionID := randomString()
+	replayed := make(chan []byte, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wsConn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			Subprotocols: []string{proxySubproto},
+		})
+		if err != nil {
+			panic(err)
+		}
+		defer wsConn.CloseNow()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+
+		conn := websocket.NetConn(ctx, wsConn, websocket.MessageBinary)
+
+		if r.URL.Path != reconnectPath(defaultProtocolVersion) {
+			conn.Write(makeSuccessFrame(sessionID))
+
+			// receive both writes but only count the first, then drop the connection
+			readTestDataFrame(t, conn)
+			readTestDataFrame(t, conn)
+			return
+		}
+
+		assert.Equal(t, sessionID, r.URL.Query().Get("sid"))
+		conn.Write(makeReconnectAckFrame(uint64(len("hello"))))
+
+		buf := []byte{}
+		for len(buf) < len("world!") {
+			buf = append(buf, readTestDataFrame(t, conn)...)
+		}
+		replayed <- buf
+	}))
+	defer server.Close()
+
+	var transcript bytes.Buffer
+	conn, err := dial(context.Background(), "ws://"+server.Listener.Addr().String(), WithReconnect(), WithTranscript(&transcript))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	conn.Write([]byte("hello"))
+	conn.Write([]byte("world"))
+	conn.Write([]byte("!"))
+
+	select {
+	case buf := <-replayed:
+		assert.Equal(t, []byte("world!"), buf)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for replayed data")
+	}
+
+	assert.Equal(t, uint64(len("hello")), conn.Sent())
+	conn.Close()
+
+	// the transcript of the reconnect leaves out the session ID
+	assert.NotContains(t, transcript.String(), sessionID)
+
+	var dials []map[string]any
+	for dec := json.NewDecoder(&transcript); dec.More(); {
+		var event map[string]any
+		assert.NoError(t, dec.Decode(&event))
+		if event["event"] == "dial" {
+			dials = append(dials, event)
+		}
+	}
+	if assert.Len(t, dials, 2) {
+		assert.Equal(t, "ws://"+server.Listener.Addr().String()+reconnectPath(defaultProtocolVersion)+"?sid=REDACTED", dials[1]["url"])
+		// nothing was received from the relay before the reconnect
+		assert.EqualValues(t, 0, dials[1]["ack"])
+	}
+}
+
+func TestResumeCheckpoint(t *testing.T) {
+	// resumeDialer is a pipeDialer that also reports the URL dialed
+	resumeDialer := func(urls chan<- string) (websocketDialer, net.Conn) {
+		dialer, relay := pipeDialer()
+		return func(ctx context.Context, url string, wsOptions *websocket.DialOptions) (net.Conn, *http.Response, error) {
+			urls <- url
+			return dialer(ctx, url, wsOptions)
+		}, relay
+	}
+
+	t.Run("Round trip", func(t *testing.T) {
+		sessionID := randomString()
+
+		dialer, relay := pipeDialer()
+		defer relay.Close()
+
+		go func() {
+			relay.Write(makeSuccessFrame(sessionID))
+			relay.Write(makeDataFrame([]byte("hello")))
+
+			// ack data, skipping the acks from the Conn
+			for {
+				frame, err := decodeFrame(relay, subprotoMaxFrameSize)
+				if err != nil {
+					return
+				}
+				if frame.Tag == subprotoTagData {
+					relay.Write(makeAckFrame(uint64(len(frame.Payload))))
+				}
+			}
+		}()
+
+		conn, err := dial(context.Background(), "ws://relay", withDialer(dialer), WithManualAck())
+		assert.NoError(t, err)
+
+		buf := make([]byte, len("hello"))
+		_, err = io.ReadFull(conn, buf)
+		assert.NoError(t, err)
+
+		// the data is counted once it's been read from the relay, which can be
+		// after Read returns
+		assert.Eventually(t, func() bool {
+			return conn.Ack() == nil && conn.Received() == uint64(len("hello"))
+		}, time.Second, time.Millisecond)
+
+		conn.Write([]byte("ping"))
+		assert.Eventually(t, func() bool {
+			return conn.Sent() == uint64(len("ping"))
+		}, time.Second, time.Millisecond)
+
+		checkpoint := conn.Checkpoint()
+		assert.Equal(t, Checkpoint{sessionID, uint64(len("ping")), uint64(len("hello"))}, checkpoint)
+		conn.Close()
+
+		// resume in what could be another process
+		urls := make(chan string, 1)
+		resumeDialer, resumeRelay := resumeDialer(urls)
+		defer resumeRelay.Close()
+
+		go func() {
+			resumeRelay.Write(makeReconnectAckFrame(checkpoint.SendAcked))
+			resumeRelay.Write(makeDataFrame([]byte("world")))
+		}()
+
+		conn, err = dial(context.Background(), "ws://relay", withDialer(resumeDialer),
+			WithResumeCheckpoint(checkpoint.SessionID, checkpoint.SendAcked, checkpoint.RecvAcked))
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		u, err := url.Parse(<-urls)
+		assert.NoError(t, err)
+		assert.Equal(t, reconnectPath(defaultProtocolVersion), u.Path)
+		assert.Equal(t, sessionID, u.Query().Get("sid"))
+		assert.Equal(t, "5", u.Query().Get("ack"))
+
+		assert.True(t, conn.Connected())
+		_, err = io.ReadFull(conn, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "world", string(buf))
+
+		assert.Equal(t, sessionID, conn.Checkpoint().SessionID)
+		assert.Equal(t, checkpoint.SendAcked, conn.Checkpoint().SendAcked)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		dialer, relay := resumeDialer(make(chan string, 1))
+		relay.Close()
+
+		_, err := dial(context.Background(), "ws://relay", withDialer(dialer), WithResumeCheckpoint(randomString(), 0, 0))
+		assert.ErrorIs(t, err, ErrSessionExpired)
+	})
+
+	t.Run("Empty session ID", func(t *testing.T) {
+		_, err := Dial(context.Background(), WithResumeCheckpoint("", 0, 0))
+		var configError *ConfigError
+		assert.ErrorAs(t, err, &configError)
+	})
+}
+
+func TestReconnectWriteError(t *testing.T) {
+	relays := make(chan net.Conn, 2)
+
+	var dials int
+	dialer := func(context.Context, string, *websocket.DialOptions) (net.Conn, *http.Response, error) {
+		client, relay := net.Pipe()
+		relays <- relay
+		resp := &http.Response{StatusCode: http.StatusSwitchingProtocols}
+
+		// every write to the first connection fails
+		if dials++; dials == 1 {
+			return &failingConn{Conn: client}, resp, nil
+		}
+		return client, resp, nil
+	}
+
+	conn, err := dial(context.Background(), "ws://relay", withDialer(dialer), WithReconnect())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	relay := <-relays
+	defer relay.Close()
+	relay.Write(makeSuccessFrame(randomString()))
+	assert.NoError(t, conn.WaitConnected(context.Background()))
+
+	_, err = conn.Write(testData)
+	assert.NoError(t, err)
+
+	var resumed net.Conn
+	select {
+	case resumed = <-relays:
+	case <-time.After(time.Second):
+		t.Fatal("didn't reconnect after the write failed")
+	}
+	defer resumed.Close()
+
+	resumed.Write(makeReconnectAckFrame(0))
+	assert.Equal(t, testData, readTestDataFrame(t, resumed))
+
+	assert.Eventually(t, func() bool {
+		return conn.Stats().Reconnects == 1
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, uint64(len(testData)), conn.Stats().BytesReplayed)
+	assert.NoError(t, conn.Err())
+}
+
+func TestResumeBatches(t *testing.T) {
+	r, w := net.Pipe()
+	defer w.Close()
+
+	conn := NewConn(r, WithReconnect())
+	defer conn.Close()
+
+	unacked := make([]byte, 2*subprotoMaxBatchFrames*subprotoMaxFrameSize+100)
+	rand.Read(unacked)
+
+	conn.sendMu.Lock()
+	conn.sendUnacked.Write(unacked)
+	conn.sendMu.Unlock()
+
+	relay, netConn := net.Pipe()
+	defer relay.Close()
+	counting := &countingConn{Conn: netConn}
+
+	replayed := make(chan []byte, 1)
+	go func() {
+		relay.Write(makeReconnectAckFrame(0))
+
+		var received []byte
+		for len(received) < len(unacked) {
+			received = append(received, readTestDataFrame(t, relay)...)
+		}
+		replayed <- received
+	}()
+
+	assert.NoError(t, conn.resume(counting))
+	assert.Equal(t, unacked, <-replayed)
+
+	// the unacked data is resent in batches, like any other large write
+	assert.Equal(t, int64(3), counting.writes.Load())
+	assert.Equal(t, uint64(len(unacked)), conn.Stats().BytesReplayed)
+}
+
+func TestReconnectTokenRefresh(t *testing.T) {
+	sessionID := randomString()
+	tokens := make(chan string, 2)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens <- r.Header.Get("Authorization")
+
+		wsConn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			Subprotocols: []string{proxySubproto},
+		})
+		if err != nil {
+			panic(err)
+		}
+		defer wsConn.CloseNow()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+
+		conn := websocket.NetConn(ctx, wsConn, websocket.MessageBinary)
+
+		// drop the first connection, as the relay does once the token expires
+		if r.URL.Path != reconnectPath(defaultProtocolVersion) {
+			conn.Write(makeSuccessFrame(sessionID))
+			readTestDataFrame(t, conn)
+			return
+		}
+
+		conn.Write(makeReconnectAckFrame(0))
+		readTestDataFrame(t, conn)
+		conn.Write(makeAckFrame(uint64(len(testData))))
+		io.Copy(io.Discard, conn)
+	}))
+	defer server.Close()
+
+	// every token expires as soon as it's issued
+	tokenSource := oauth2.ReuseTokenSource(nil, &expiringTokenSource{})
+
+	conn, err := dial(context.Background(), "ws://"+server.Listener.Addr().String(), WithReconnect(), WithTokenSource(&tokenSource))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	conn.Write(testData)
+
+	assert.Eventually(t, func() bool {
+		return conn.Sent() == uint64(len(testData))
+	}, 5*time.Second, time.Millisecond)
+
+	assert.Equal(t, "Bearer token-1", <-tokens)
+	assert.Equal(t, "Bearer token-2", <-tokens)
+	assert.NoError(t, conn.Err())
+}
+
+func TestReconnectStats(t *testing.T) {
+	sessionID := randomString()
+	reconnects := atomic.Int32{}
+	done := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first reconnect attempt fails
+		n := int32(0)
+		if r.URL.Path == reconnectPath(defaultProtocolVersion) {
+			if n = reconnects.Add(1); n == 1 {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		wsConn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			Subprotocols: []string{proxySubproto},
+		})
+		if err != nil {
+			panic(err)
+		}
+		defer wsConn.CloseNow()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+
+		conn := websocket.NetConn(ctx, wsConn, websocket.MessageBinary)
+
+		switch n {
+		case 0:
+			conn.Write(makeSuccessFrame(sessionID))
+		default:
+			conn.Write(makeReconnectAckFrame(0))
+		}
+
+		// drop the connection without acking until the second reconnect
+		assert.Equal(t, []byte("hello"), readTestDataFrame(t, conn))
+		if n < 3 {
+			return
+		}
+
+		conn.Write(makeAckFrame(uint64(len("hello"))))
+		close(done)
+		io.Copy(io.Discard, conn)
+	}))
+	defer server.Close()
+
+	type attempt struct {
+		n   int
+		err bool
+	}
+	var attempts []attempt
+
+	conn, err := dial(context.Background(), "ws://"+server.Listener.Addr().String(),
+		WithReconnect(),
+		WithReconnectCallback(func(n int, err error) {
+			attempts = append(attempts, attempt{n, err != nil})
+		}),
+	)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	conn.Write([]byte("hello"))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for reconnects")
+	}
+
+	assert.Eventually(t, func() bool {
+		return conn.Sent() == uint64(len("hello"))
+	}, time.Second, time.Millisecond)
+
+	stats := conn.Stats()
+	assert.Equal(t, uint64(2), stats.Reconnects)
+	assert.Equal(t, uint64(2*len("hello")), stats.BytesReplayed)
+	assert.Equal(t, []attempt{{1, true}, {2, false}, {1, false}}, attempts)
+}
+
+func TestSendWindow(t *testing.T) {
+	r, w := net.Pipe()
+	defer w.Close()
+
+	conn := NewConn(r, WithReconnect())
+	defer conn.Close()
+
+	w.Write(makeSuccessFrame(randomString()))
+	go io.Copy(io.Discard, w)
+
+	assert.Equal(t, uint64(subprotoSendWindow), conn.SendWindow())
+
+	var configError *ConfigError
+	assert.ErrorAs(t, conn.SetSendWindow(subprotoMaxFrameSize), &configError)
+	assert.ErrorAs(t, conn.SetSendWindow(maxSendWindow+1), &configError)
+	assert.NoError(t, conn.SetSendWindow(minSendWindow))
+	assert.Equal(t, uint64(minSendWindow), conn.SendWindow())
+
+	// the relay never acks, so filling the window stalls the next write
+	_, err := conn.Write(make([]byte, minSendWindow))
+	assert.NoError(t, err)
+
+	written := make(chan struct{})
+	go func() {
+		conn.Write(testData)
+		close(written)
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("write didn't stall with a full send window")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.NoError(t, conn.SetSendWindow(minSendWindow+subprotoMaxFrameSize))
+
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("write didn't resume after growing the send window")
+	}
+
+	t.Run("Without reconnect", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r)
+		defer conn.Close()
+
+		assert.ErrorAs(t, conn.SetSendWindow(minSendWindow), &configError)
+		assert.Zero(t, conn.SendWindow())
+	})
+}
+
+func TestLargeWrite(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+
+	t.Run("Incremental acks", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r, WithReconnect())
+		defer conn.Close()
+
+		w.Write(makeSuccessFrame(randomString()))
+		assert.NoError(t, conn.SetSendWindow(minSendWindow))
+
+		// the relay acks every frame, freeing up the window a little at a time
+		received := make(chan []byte, 1)
+		go func() {
+			var buf []byte
+			for len(buf) < len(data) {
+				buf = append(buf, readTestDataFrame(t, w)...)
+				w.Write(makeAckFrame(uint64(len(buf))))
+			}
+			received <- buf
+		}()
+
+		n, err := conn.Write(data)
+		assert.NoError(t, err)
+		assert.Equal(t, len(data), n)
+
+		select {
+		case buf := <-received:
+			assert.Equal(t, data, buf)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for data")
+		}
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r, WithReconnect())
+		defer conn.Close()
+
+		w.Write(makeSuccessFrame(randomString()))
+		assert.NoError(t, conn.SetSendWindow(minSendWindow))
+		go io.Copy(io.Discard, w)
+
+		// the relay never acks, so the write stalls once the window is full
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		n, err := conn.WriteContext(ctx, data)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Equal(t, minSendWindow, n)
+		assert.NoError(t, conn.Err())
+	})
+
+	t.Run("Canceled while writing", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		counting := &countingConn{Conn: r}
+		conn := NewConn(counting)
+		defer conn.Close()
+
+		w.Write(makeSuccessFrame(randomString()))
+
+		// the relay stalls, so the first batch can't be written, but it's on
+		// its way and counted as sent
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			assert.Eventually(t, func() bool {
+				return counting.writes.Load() == 1
+			}, time.Second, time.Millisecond)
+			cancel()
+		}()
+
+		batch := subprotoMaxBatchFrames * subprotoMaxFrameSize
+		n, err := conn.WriteContext(ctx, data)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, batch, n)
+
+		// the rest of data isn't sent, and the connection can still be used
+		go func() {
+			_, err := conn.Write(testData)
+			assert.NoError(t, err)
+		}()
+
+		var received []byte
+		for len(received) < batch {
+			received = append(received, readTestDataFrame(t, w)...)
+		}
+		assert.Equal(t, data[:batch], received)
+		assert.Equal(t, testData, readTestDataFrame(t, w))
+	})
+
+	t.Run("Deadline while writing", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		counting := &countingConn{Conn: r}
+		conn := NewConn(counting)
+		defer conn.Close()
+
+		w.Write(makeSuccessFrame(randomString()))
+
+		// as when canceled, the batch on its way is counted as sent
+		go func() {
+			assert.Eventually(t, func() bool {
+				return counting.writes.Load() == 1
+			}, time.Second, time.Millisecond)
+			conn.SetWriteDeadline(time.Now())
+		}()
+
+		batch := subprotoMaxBatchFrames * subprotoMaxFrameSize
+		n, err := conn.Write(data)
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+		assert.Equal(t, batch, n)
+
+		var received []byte
+		for len(received) < batch {
+			received = append(received, readTestDataFrame(t, w)...)
+		}
+		assert.Equal(t, data[:batch], received)
+
+		// so resending the rest doesn't duplicate anything
+		conn.SetWriteDeadline(time.Time{})
+		go func() {
+			_, err := conn.Write(data[n:])
+			assert.NoError(t, err)
+		}()
+
+		received = received[:0]
+		for len(received) < len(data)-batch {
+			received = append(received, readTestDataFrame(t, w)...)
+		}
+		assert.Equal(t, data[batch:], received)
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	t.Run("Burst", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		clock := newFakeClock()
+		conn := NewConn(r, WithRateLimit(64*1024), withClock(clock))
+		defer conn.Close()
+
+		w.Write(makeSuccessFrame(randomString()))
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := conn.Write(make([]byte, 3*subprotoMaxFrameSize))
+			done <- err
+		}()
+
+		// a frame goes at once
+		assert.Len(t, readTestDataFrame(t, w), subprotoMaxFrameSize)
+
+		// and each of the others waits a quarter of a second for its share
+		for i := 0; i < 2; i++ {
+			assert.Eventually(t, func() bool {
+				return clock.waiting() == 1
+			}, time.Second, time.Millisecond)
+
+			clock.advance(200 * time.Millisecond)
+			assert.Equal(t, 1, clock.waiting())
+
+			clock.advance(50 * time.Millisecond)
+			assert.Len(t, readTestDataFrame(t, w), subprotoMaxFrameSize)
+		}
+
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("Write didn't return")
+		}
+	})
+
+	t.Run("Deadline", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r, WithRateLimit(1024))
+		defer conn.Close()
+
+		w.Write(makeSuccessFrame(randomString()))
+		go io.Copy(io.Discard, w)
+
+		conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err := conn.Write(make([]byte, 64*1024))
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+		assert.NoError(t, conn.Err())
+	})
+
+	t.Run("Bucket", func(t *testing.T) {
+		now := time.Now()
+		l := newRateLimiter(1000, now)
+
+		assert.Zero(t, l.reserve(1000, now))
+		assert.Equal(t, time.Second, l.reserve(1000, now))
+		// the debt is paid off and the bucket refills up to the burst
+		assert.Zero(t, l.reserve(1000, now.Add(3*time.Second)))
+		assert.Equal(t, 500*time.Millisecond, l.reserve(500, now.Add(3*time.Second)))
+	})
+}
+
+func TestAckRegression(t *testing.T) {
+	// ackTwice sends data, has it acked and then acked again with fewer bytes. The
+	// returned channel is closed once both acks have been handled.
+	ackTwice := func(t *testing.T, opts ...DialOption) (*Conn, <-chan struct{}) {
+		r, w := net.Pipe()
+		t.Cleanup(func() { w.Close() })
+
+		conn := NewConn(r, append(opts, WithReconnect())...)
+		t.Cleanup(func() { conn.Close() })
+
+		w.Write(makeSuccessFrame(randomString()))
+		go conn.Write([]byte("hello world"))
+		readTestDataFrame(t, w)
+
+		handled := make(chan struct{})
+		go func() {
+			w.Write(makeAckFrame(uint64(len("hello world"))))
+			w.Write(makeAckFrame(uint64(len("hello"))))
+			// the empty frame is only read once the ack before it has been handled
+			w.Write(makeDataFrame(nil))
+			close(handled)
+			io.Copy(io.Discard, w)
+		}()
+		return conn, handled
+	}
+
+	t.Run("Ignore", func(t *testing.T) {
+		conn, handled := ackTwice(t)
+
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatal("acks weren't handled")
+		}
+
+		assert.Equal(t, uint64(len("hello world")), conn.Sent())
+		assert.NoError(t, conn.Err())
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		conn, _ := ackTwice(t, WithAckRegressionMode(AckRegressionError))
+
+		assert.Eventually(t, func() bool {
+			return conn.Err() != nil
+		}, time.Second, time.Millisecond)
+
+		var protocolError *ProtocolError
+		assert.ErrorAs(t, conn.Err(), &protocolError)
+		assert.ErrorIs(t, conn.Err(), ErrAckRegression)
+		assert.Equal(t, uint64(len("hello world")), conn.Sent())
+	})
+
+	t.Run("Reconnect", func(t *testing.T) {
+		dialer, relay := pipeDialer()
+		defer relay.Close()
+
+		// the relay has lost data it acked before, which can't be resent
+		go relay.Write(makeReconnectAckFrame(5))
+
+		_, err := dial(context.Background(), "ws://relay", withDialer(dialer), WithResumeCheckpoint(randomString(), 10, 0))
+		assert.ErrorIs(t, err, ErrAckRegression)
+	})
+}
+
+func TestSendReady(t *testing.T) {
+	r, w := net.Pipe()
+	defer w.Close()
+
+	conn := NewConn(r, WithReconnect())
+	defer conn.Close()
+
+	w.Write(makeSuccessFrame(randomString()))
+	go io.Copy(io.Discard, w)
+
+	assert.NoError(t, conn.SetSendWindow(minSendWindow))
+	assert.True(t, conn.SendReady())
+	assert.Equal(t, uint64(minSendWindow), conn.SendWindowRemaining())
+
+	_, err := conn.Write(make([]byte, minSendWindow-len(testData)))
+	assert.NoError(t, err)
+	assert.True(t, conn.SendReady())
+	assert.Equal(t, uint64(len(testData)), conn.SendWindowRemaining())
+
+	_, err = conn.Write(testData)
+	assert.NoError(t, err)
+	assert.False(t, conn.SendReady())
+	assert.Zero(t, conn.SendWindowRemaining())
+
+	w.Write(makeAckFrame(minSendWindow))
+
+	assert.Eventually(t, conn.SendReady, time.Second, time.Millisecond)
+	assert.Equal(t, uint64(minSendWindow), conn.SendWindowRemaining())
+
+	t.Run("Without reconnect", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r)
+		defer conn.Close()
+
+		assert.True(t, conn.SendReady())
+		assert.Zero(t, conn.SendWindowRemaining())
+	})
+}
+
+func TestCloseGracefully(t *testing.T) {
+	t.Run("Flushed", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r, WithReconnect(), WithWriteCoalesce(time.Hour))
+		defer conn.Close()
+
+		w.Write(makeSuccessFrame(randomString()))
+
+		_, err := conn.Write(testData)
+		assert.NoError(t, err)
+
+		closed := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			closed <- conn.CloseGracefully(ctx)
+		}()
+
+		assert.Equal(t, testData, readTestDataFrame(t, w))
+
+		select {
+		case <-closed:
+			t.Fatal("closed before the relay acked")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		w.Write(makeAckFrame(uint64(len(testData))))
+
+		assert.NoError(t, <-closed)
+		assert.ErrorIs(t, conn.Err(), net.ErrClosed)
+
+		_, err = conn.Write(testData)
+		assert.ErrorIs(t, err, net.ErrClosed)
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r, WithReconnect())
+		defer conn.Close()
+
+		w.Write(makeSuccessFrame(randomString()))
+		go io.Copy(io.Discard, w)
+
+		_, err := conn.Write(testData)
+		assert.NoError(t, err)
+
+		// the relay never acks, so the deadline passes
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		assert.ErrorIs(t, conn.CloseGracefully(ctx), context.DeadlineExceeded)
+		assert.ErrorIs(t, conn.Err(), net.ErrClosed)
+	})
+}
+
+func TestRingBuffer(t *testing.T) {
+	r := newRingBuffer(4)
+	r.Write([]byte("abc"))
+	r.Discard(2)
+	r.Write([]byte("def"))
+
+	assert.Equal(t, 4, r.Len())
+	assert.Equal(t, 0, r.Free())
+
+	head, tail := r.Bytes()
+	assert.Equal(t, []byte("cdef"), append(append([]byte{}, head...), tail...))
+
+	assert.Panics(t, func() { r.Write([]byte("g")) })
+
+	r.Grow(6)
+	r.Write([]byte("gh"))
+	assert.Equal(t, 6, r.Cap())
+
+	head, tail = r.Bytes()
+	assert.Equal(t, []byte("cdefgh"), append(append([]byte{}, head...), tail...))
+
+	buf := make([]byte, 3)
+	assert.Equal(t, 3, r.Read(buf))
+	assert.Equal(t, []byte("cde"), buf)
+
+	// the free space wraps, so only the part after the buffered bytes is available
+	r.Discard(1)
+	r.Write([]byte("i"))
+	assert.Len(t, r.Available(), 3)
+	r.Commit(copy(r.Available(), "jk"))
+
+	head, tail = r.Bytes()
+	assert.Equal(t, []byte("ghijk"), append(append([]byte{}, head...), tail...))
+}
+
+func TestCompressionMode(t *testing.T) {
+	tests := []struct {
+		opt  DialOption
+		mode websocket.CompressionMode
+	}{
+		{func(*dialOptions) {}, websocket.CompressionDisabled},
+		{WithCompressionMode(CompressionDisabled), websocket.CompressionDisabled},
+		{WithCompressionMode(CompressionContextTakeover), websocket.CompressionContextTakeover},
+		{WithCompressionMode(CompressionNoContextTakeover), websocket.CompressionNoContextTakeover},
+		{WithCompression(), websocket.CompressionContextTakeover},
+	}
+
+	for _, test := range tests {
+		dopts := &dialOptions{}
+		dopts.collectOpts([]DialOption{test.opt})
+
+		assert.Equal(t, test.mode, websocketDialOptions(dopts).CompressionMode)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	r, w := net.Pipe()
+	defer w.Close()
+
+	conn := NewConn(r)
+	defer conn.Close()
+
+	w.Write(makeSuccessFrame(randomString()))
+
+	// nothing reads from the relay end yet, so writes stall
+	conn.SetDeadline(time.Now().Add(50 * time.Millisecond))
+
+	_, err := conn.Read(make([]byte, 1))
+	var netError net.Error
+	assert.ErrorAs(t, err, &netError)
+	assert.True(t, netError.Timeout())
+
+	conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = conn.Write(testData)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// a deadline in the past fails immediately
+	conn.SetDeadline(time.Now().Add(-time.Second))
+	_, err = conn.Peek(1)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	_, err = conn.Write(testData)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// clearing the deadline recovers the connection, and the timed out write
+	// is still delivered
+	conn.SetDeadline(time.Time{})
+
+	go func() {
+		w.Write(makeDataFrame(testData))
+		readTestDataFrame(t, w)
+		readTestDataFrame(t, w)
+	}()
+
+	buf := make([]byte, len(testData))
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, testData, buf)
+
+	n, err := conn.Write(testData)
+	assert.NoError(t, err)
+	assert.Equal(t, len(testData), n)
+}
+
+func TestWriteBackpressure(t *testing.T) {
+	r, w := net.Pipe()
+	defer w.Close()
+
+	counting := &countingConn{Conn: r}
+	conn := NewConn(counting)
+	defer conn.Close()
+
+	w.Write(makeSuccessFrame(randomString()))
+
+	var written atomic.Int32
+	done := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		go func() {
+			if _, err := conn.Write(make([]byte, 1024)); err == nil {
+				written.Add(1)
+			}
+			done <- struct{}{}
+		}()
+	}
+
+	// the relay reads one frame at a time, and every writer waits its turn
+	// rather than queueing its data: only one write reaches the relay at once,
+	// and it doesn't return until the relay has read it
+	for i := 0; i < 10; i++ {
+		assert.Eventually(t, func() bool {
+			return counting.writes.Load() == int64(i+1)
+		}, time.Second, time.Millisecond)
+		assert.Equal(t, int32(i), written.Load())
+
+		assert.Len(t, readTestDataFrame(t, w), 1024)
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("write didn't finish after the relay read it")
+		}
+	}
+	assert.Equal(t, int32(10), written.Load())
+}
+
+func TestDeadlineMidFrame(t *testing.T) {
+	r, w := net.Pipe()
+	defer w.Close()
+
+	conn := NewConn(r)
+	defer conn.Close()
+
+	w.Write(makeSuccessFrame(randomString()))
+
+	// the relay stalls partway through a frame
+	frame := makeDataFrame([]byte("hello world"))
+	resume := make(chan struct{})
+	go func() {
+		w.Write(frame[:len(frame)-len(" world")])
+		<-resume
+		w.Write(frame[len(frame)-len(" world"):])
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	buf := make([]byte, len("hello world"))
+	n, err := conn.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+
+	_, err = conn.Read(buf)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// the rest of the frame is delivered once the deadline is cleared
+	conn.SetReadDeadline(time.Time{})
+	close(resume)
+
+	_, err = io.ReadFull(conn, buf[:len(" world")])
+	assert.NoError(t, err)
+	assert.Equal(t, " world", string(buf[:len(" world")]))
+}
+
+func TestPeek(t *testing.T) {
+	t.Run("Then Read", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r)
+		defer conn.Close()
+
+		go func() {
+			w.Write(makeSuccessFrame(randomString()))
+			w.Write(makeDataFrame(testData))
+		}()
+
+		buf, err := conn.Peek(3)
+		assert.NoError(t, err)
+		assert.Equal(t, testData[:3], buf)
+
+		buf = make([]byte, len(testData))
+		_, err = io.ReadFull(conn, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, testData, buf)
+	})
+
+	t.Run("After close", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r)
+		assert.NoError(t, conn.Close())
+
+		_, err := conn.Peek(3)
+		assert.ErrorIs(t, err, net.ErrClosed)
+	})
+}
+
+func TestCopy(t *testing.T) {
+	data := make([]byte, 3*subprotoMaxFrameSize+100)
+	rand.Read(data)
+
+	t.Run("ReadFrom", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r)
+		defer conn.Close()
+
+		received := make(chan []byte)
+		go func() {
+			buf := []byte{}
+			for len(buf) < len(data) {
+				buf = append(buf, readTestDataFrame(t, w)...)
+			}
+			received <- buf
+		}()
+
+		n, err := conn.ReadFrom(bytes.NewReader(data))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(data)), n)
+		assert.Equal(t, data, <-received)
+	})
+
+	t.Run("WriteTo", func(t *testing.T) {
+		r, w := net.Pipe()
+
+		conn := NewConn(r)
+		defer conn.Close()
+
+		go io.Copy(io.Discard, w)
+		go func() {
+			w.Write(makeSuccessFrame(randomString()))
+			for buf := data; len(buf) > 0; {
+				n := min(len(buf), subprotoMaxFrameSize)
+				w.Write(makeDataFrame(buf[:n]))
+				buf = buf[n:]
+			}
+			w.Close()
+		}()
+
+		var out bytes.Buffer
+		n, err := conn.WriteTo(&out)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(data)), n)
+		assert.Equal(t, data, out.Bytes())
+	})
+}
+
+func TestBufferSize(t *testing.T) {
+	t.Run("Read buffer", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r, WithReadBufferSize(64))
+		defer conn.Close()
+
+		assert.Equal(t, 64, conn.recvPeeker.Size())
+
+		go func() {
+			w.Write(makeSuccessFrame(randomString()))
+			w.Write(makeDataFrame(testData))
+		}()
+
+		// the whole frame is buffered by the first read
+		buf := make([]byte, 1)
+		for _, b := range testData {
+			_, err := conn.Read(buf)
+			assert.NoError(t, err)
+			assert.Equal(t, b, buf[0])
+		}
+	})
+
+	t.Run("Small write buffer", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r, WithWriteBufferSize(2))
+		defer conn.Close()
+
+		assert.Len(t, conn.sendBuf, 2)
+		assert.Equal(t, 2, conn.coalesceThreshold)
+
+		go conn.Write(testData)
+
+		assert.Equal(t, testData[0:2], readTestDataFrame(t, w))
+		assert.Equal(t, testData[2:4], readTestDataFrame(t, w))
+		assert.Equal(t, testData[4:], readTestDataFrame(t, w))
+	})
+
+	t.Run("Large write buffer", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		// more than a batch, so the frames don't fit a pooled batch buffer
+		size := 2 * subprotoMaxBatchFrames * subprotoMaxFrameSize
+		conn := NewConn(r, WithWriteBufferSize(size), WithWriteCoalesce(time.Hour))
+		defer conn.Close()
+
+		assert.Equal(t, size, conn.coalesceThreshold)
+
+		// small writes build up the frames, sent once the buffer fills
+		go func() {
+			chunk := make([]byte, 1024)
+			for i := 0; i < size/len(chunk); i++ {
+				conn.Write(chunk)
+			}
+		}()
+
+		for i := 0; i < 2*subprotoMaxBatchFrames; i++ {
+			assert.Len(t, readTestDataFrame(t, w), subprotoMaxFrameSize)
+		}
+	})
+
+	t.Run("Negative", func(t *testing.T) {
+		_, err := Dial(context.Background(), WithReadBufferSize(-1))
+		var configError *ConfigError
+		assert.ErrorAs(t, err, &configError)
+	})
+}
+
+// fakeClock is a clock whose time only moves with advance.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) clockTimer {
+	return c.newTimer(d, 0)
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) clockTicker {
+	return fakeTicker{c.newTimer(d, d)}
+}
+
+func (c *fakeClock) newTimer(d, period time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1), when: c.now.Add(d), period: period, armed: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// advance moves the time on by d, firing the timers that are due.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	for _, t := range c.timers {
+		if !t.armed || t.when.After(c.now) {
+			continue
+		}
+		if t.fn != nil {
+			go t.fn()
+		} else {
+			select {
+			case t.c <- c.now:
+			default:
+			}
+		}
+		if t.period > 0 {
+			t.when = c.now.Add(t.period)
+		} else {
+			t.armed = false
+		}
+	}
+}
+
+// waiting returns the number of timers that haven't fired or been stopped.
+func (c *fakeClock) waiting() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var n int
+	for _, t := range c.timers {
+		if t.armed {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	t := c.newTimer(d, 0)
+	t.fn = f
+	return t
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	c      chan time.Time
+	fn     func()
+	when   time.Time
+	period time.Duration
+	armed  bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	armed := t.armed
+	t.armed = false
+	return armed
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	armed := t.armed
+	t.when, t.armed = t.clock.now.Add(d), true
+	return armed
+}
+
+type fakeTicker struct{ *fakeTimer }
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
+
+func TestIdleTimeout(t *testing.T) {
+	t.Run("Without traffic", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		clock := newFakeClock()
+		conn := NewConn(r, WithIdleTimeout(time.Minute), withClock(clock))
+		defer conn.Close()
+
+		assert.Eventually(t, func() bool {
+			return clock.waiting() == 1
+		}, time.Second, time.Millisecond)
+		clock.advance(time.Minute)
+
+		assert.Eventually(t, func() bool {
+			return conn.Err() != nil
+		}, time.Second, time.Millisecond)
+		assert.ErrorIs(t, conn.Err(), ErrIdleTimeout)
+	})
+
+	t.Run("With traffic", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		clock := newFakeClock()
+		conn := NewConn(r, WithIdleTimeout(time.Minute), withClock(clock))
+		defer conn.Close()
+
+		go io.Copy(io.Discard, w)
+
+		// well past the timeout in total, but never idle for all of it
+		for i := 0; i < 5; i++ {
+			assert.Eventually(t, func() bool {
+				return clock.waiting() == 1
+			}, time.Second, time.Millisecond)
+
+			_, err := conn.Write(testData)
+			assert.NoError(t, err)
+			clock.advance(40 * time.Second)
+		}
+		assert.NoError(t, conn.Err())
+	})
+
+	t.Run("Fake clock", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		clock := newFakeClock()
+		conn := NewConn(r, WithIdleTimeout(time.Minute), withClock(clock))
+		defer conn.Close()
+
+		go io.Copy(io.Discard, w)
+
+		// the timer is rearmed for the rest of the timeout each time it fires early
+		waitArmed := func() {
+			assert.Eventually(t, func() bool {
+				return clock.waiting() == 1
+			}, time.Second, time.Millisecond)
+		}
+		waitArmed()
+
+		clock.advance(30 * time.Second)
+		waitArmed()
+
+		_, err := conn.Write(testData)
+		assert.NoError(t, err)
+
+		clock.advance(30 * time.Second)
+		waitArmed()
+		assert.NoError(t, conn.Err())
+
+		clock.advance(30 * time.Second)
+		assert.Eventually(t, func() bool {
+			return conn.Err() != nil
+		}, time.Second, time.Millisecond)
+		assert.ErrorIs(t, conn.Err(), ErrIdleTimeout)
+	})
+}
+
+func TestValidateHost(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []DialOption
+		host string
+		ok   bool
+	}{
+		{"IPv4", []DialOption{WithHost("10.0.0.1", "region", "network", "group")}, "10.0.0.1", true},
+		{"IPv6", []DialOption{WithHost("fd00::1", "region", "network", "group")}, "fd00::1", true},
+		{"IPv6 in brackets", []DialOption{WithHost("[fd00::1]", "region", "network", "group")}, "fd00::1", true},
+		{"Hostname", []DialOption{WithHost("db-1.internal.example.com", "region", "network", "group")}, "db-1.internal.example.com", true},
+		{"Bad host", []DialOption{WithHost("db_1..example", "region", "network", "group")}, "", false},
+		{"Host and instance", []DialOption{WithHost("10.0.0.1", "region", "network", "group"), WithInstance("instance", "zone", "nic0")}, "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dopts := &dialOptions{}
+			dopts.collectOpts(test.opts)
+
+			err := dopts.validate()
+			if test.ok {
+				assert.NoError(t, err)
+				assert.Contains(t, connectURL(dopts), "host="+url.QueryEscape(test.host))
+			} else {
+				var configError *ConfigError
+				assert.ErrorAs(t, err, &configError)
+			}
+		})
+	}
+}
+
+func TestValidateProject(t *testing.T) {
+	tests := []struct {
+		name    string
+		opt     DialOption
+		project string
+		ok      bool
+	}{
+		{"ID", WithProject("my-proj-123"), "my-proj-123", true},
+		{"Number", WithProject("123456789012"), "123456789012", true},
+		{"Domain-scoped ID", WithProject("example.com:my-proj"), "example.com:my-proj", true},
+		{"Project number option", WithProjectNumber(123456789012), "123456789012", true},
+		{"Empty", WithProject(""), "", false},
+		{"Spaces", WithProject("my proj"), "", false},
+		{"Uppercase", WithProject("My-Proj"), "", false},
+		{"Trailing hyphen", WithProject("my-proj-"), "", false},
+		{"Negative number", WithProjectNumber(-1), "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dopts := &dialOptions{}
+			dopts.collectOpts([]DialOption{test.opt})
+
+			err := dopts.validate()
+			if test.ok {
+				assert.NoError(t, err)
+				assert.Contains(t, connectURL(dopts), "project="+url.QueryEscape(test.project))
+			} else {
+				var configError *ConfigError
+				assert.ErrorAs(t, err, &configError)
+			}
+		})
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		want   dialOptions
+		ok     bool
+	}{
+		{"Resource path", "projects/my-proj/zones/us-central1-a/instances/my-instance", dialOptions{Project: "my-proj", Zone: "us-central1-a", Instance: "my-instance", Interface: "nic0"}, true},
+		{"Resource path with port", "projects/my-proj/zones/us-central1-a/instances/my-instance:22", dialOptions{Project: "my-proj", Zone: "us-central1-a", Instance: "my-instance", Interface: "nic0", Port: "22"}, true},
+		{"Shorthand with port", "my-proj/us-central1-a/my-instance:22", dialOptions{Project: "my-proj", Zone: "us-central1-a", Instance: "my-instance", Interface: "nic0", Port: "22"}, true},
+		{"Domain-scoped project", "example.com:my-proj/us-central1-a/my-instance", dialOptions{Project: "example.com:my-proj", Zone: "us-central1-a", Instance: "my-instance", Interface: "nic0"}, true},
+		{"Instance only", "my-instance", dialOptions{}, false},
+		{"Wrong collection", "projects/my-proj/regions/us-central1/instances/my-instance", dialOptions{}, false},
+		{"Invalid project", "My Proj/us-central1-a/my-instance", dialOptions{}, false},
+		{"Empty instance", "my-proj/us-central1-a/", dialOptions{}, false},
+		{"Invalid port", "my-proj/us-central1-a/my-instance:ssh", dialOptions{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts, err := ParseTarget(test.target)
+			if !test.ok {
+				var configError *ConfigError
+				assert.ErrorAs(t, err, &configError)
+				return
+			}
+			assert.NoError(t, err)
+
+			dopts := &dialOptions{}
+			dopts.collectOpts(opts)
+			assert.Equal(t, test.want, *dopts)
+		})
+	}
+}
+
+func TestParseHost(t *testing.T) {
+	tests := []struct {
+		addr string
+		host string
+		port string
+		ok   bool
+	}{
+		{"10.0.0.1", "10.0.0.1", "", true},
+		{"10.0.0.1:22", "10.0.0.1", "22", true},
+		{"[2001:db8::1]:22", "2001:db8::1", "22", true},
+		{"[2001:db8::1]", "2001:db8::1", "", true},
+		{"2001:db8::1", "2001:db8::1", "", true},
+		{"::1", "::1", "", true},
+		{"host.internal", "host.internal", "", true},
+		{"host.internal:2222", "host.internal", "2222", true},
+		{"host.internal:", "", "", false},
+		{"host.internal:ssh", "", "", false},
+		{"host.internal:0", "", "", false},
+		{":22", "", "", false},
+		{"", "", "", false},
+		{"[2001:db8::1", "", "", false},
+		{"[host.internal]", "", "", false},
+		{"2001:db8::1]:22", "", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.addr, func(t *testing.T) {
+			host, port, err := ParseHost(test.addr)
+			if !test.ok {
+				var configError *ConfigError
+				assert.ErrorAs(t, err, &configError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.host, host)
+			assert.Equal(t, test.port, port)
+		})
+	}
+}
+
+func TestResolveLocation(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []DialOption
+		ok   bool
+	}{
+		{"Instance with zone", []DialOption{WithInstance("instance", "zone", "nic0")}, true},
+		{"Instance without zone", []DialOption{WithInstance("instance", "", "nic0")}, false},
+		{"Instance with region", []DialOption{WithInstance("instance", "zone", "nic0"), withLocation("", "region")}, false},
+		{"Host with region", []DialOption{WithHost("host", "region", "network", "group")}, true},
+		{"Host without region", []DialOption{WithHost("host", "", "network", "group")}, false},
+		{"Host with zone", []DialOption{WithHost("host", "region", "network", "group"), withLocation("zone", "")}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dopts := &dialOptions{}
+			dopts.collectOpts(test.opts)
+
+			err := dopts.resolveLocation(context.Background())
+			if test.ok {
+				assert.NoError(t, err)
+			} else {
+				var configError *ConfigError
+				assert.ErrorAs(t, err, &configError)
+			}
+		})
+	}
+}
+
+func TestAutoZone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Google", r.Header.Get("Metadata-Flavor"))
+		assert.Equal(t, "/computeMetadata/v1/instance/zone", r.URL.Path)
+
+		w.Write([]byte("projects/123456789012/zones/europe-west2-a"))
+	}))
+	defer server.Close()
+
+	t.Setenv("GCE_METADATA_HOST", server.Listener.Addr().String())
+
+	t.Run("Instance", func(t *testing.T) {
+		dopts := &dialOptions{}
+		dopts.collectOpts([]DialOption{WithInstance("instance", "", "nic0"), WithAutoZone()})
+
+		assert.NoError(t, dopts.resolveLocation(context.Background()))
+		assert.Equal(t, "europe-west2-a", dopts.Zone)
+		assert.Empty(t, dopts.Region)
+	})
+
+	t.Run("Host", func(t *testing.T) {
+		dopts := &dialOptions{}
+		dopts.collectOpts([]DialOption{WithHost("host", "", "network", "group"), WithAutoZone()})
+
+		assert.NoError(t, dopts.resolveLocation(context.Background()))
+		assert.Equal(t, "europe-west2", dopts.Region)
+		assert.Empty(t, dopts.Zone)
+	})
+}
+
+func TestAck(t *testing.T) {
+	t.Run("Over threshold", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r)
+		defer conn.Close()
+
+		data := make([]byte, subprotoMaxFrameSize)
+
+		go func() {
+			w.Write(makeSuccessFrame(randomString()))
+			for i := 0; i < 3; i++ {
+				w.Write(makeDataFrame(data))
+			}
+		}()
+		go io.Copy(io.Discard, conn)
+
+		buf := make([]byte, 10)
+		_, err := io.ReadFull(w, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, makeAckFrame(3*subprotoMaxFrameSize), buf)
+	})
+
+	t.Run("With ack delay", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		clock := newFakeClock()
+		conn := NewConn(r, WithAckDelay(50*time.Millisecond), withClock(clock))
+		defer conn.Close()
+
+		go io.Copy(io.Discard, conn)
+
+		// two bursts under the threshold, each acked once data stops arriving. The
+		// empty frames are only read once the data before them has been handled.
+		w.Write(makeSuccessFrame(randomString()))
+		w.Write(makeDataFrame(testData))
+		w.Write(makeDataFrame(testData))
+		w.Write(makeDataFrame(nil))
+		clock.advance(50 * time.Millisecond)
+
+		buf := make([]byte, 10)
+		_, err := io.ReadFull(w, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, makeAckFrame(uint64(2*len(testData))), buf)
+
+		w.Write(makeDataFrame(testData))
+		w.Write(makeDataFrame(nil))
+		clock.advance(50 * time.Millisecond)
+
+		_, err = io.ReadFull(w, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, makeAckFrame(uint64(3*len(testData))), buf)
+		assert.Equal(t, uint64(3*len(testData)), conn.Received())
+	})
+
+	t.Run("With manual ack", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		counting := &countingConn{Conn: r}
+		conn := NewConn(counting, WithManualAck())
+		defer conn.Close()
+
+		data := make([]byte, subprotoMaxFrameSize)
+
+		w.Write(makeSuccessFrame(randomString()))
+		go io.Copy(io.Discard, conn)
+		for i := 0; i < 3; i++ {
+			w.Write(makeDataFrame(data))
+		}
+		assertNoAck(t, w, counting)
+
+		go func() {
+			assert.NoError(t, conn.Ack())
+		}()
+
+		buf := make([]byte, 10)
+		_, err := io.ReadFull(w, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, makeAckFrame(3*subprotoMaxFrameSize), buf)
+	})
+
+	t.Run("With acked ahead of received", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		counting := &countingConn{Conn: r}
+		conn := NewConn(counting)
+		defer conn.Close()
+
+		conn.recvNbAcked = 100
+		conn.recvNbUnacked = 50
+
+		w.Write(makeSuccessFrame(randomString()))
+		go w.Write(makeDataFrame(testData))
+
+		buf := make([]byte, len(testData))
+		_, err := io.ReadFull(conn, buf)
+		assert.NoError(t, err)
+		assertNoAck(t, w, counting)
+	})
+}
+
+// assertNoAck checks that conn, which wraps the relay end of w, hasn't sent an ack
+// for the frames written to w so far. Acks are sent by the read loop before it
+// reads the next frame, so once an empty frame is taken from w any ack is already
+// on the wire. The deadline only bounds how long a wrongly sent ack stalls the test.
+func assertNoAck(t *testing.T, w net.Conn, conn *countingConn) {
+	t.Helper()
+
+	w.SetWriteDeadline(time.Now().Add(time.Second))
+	defer w.SetWriteDeadline(time.Time{})
+
+	_, err := w.Write(makeDataFrame(nil))
+	assert.NoError(t, err)
+	assert.Zero(t, conn.writes.Load())
+}
+
+func TestStats(t *testing.T) {
+	t.Run("Rate", func(t *testing.T) {
+		m := rateMeter{window: time.Second}
+		now := time.Now()
+
+		// 1000 bytes every 10ms is 100KB/s
+		for i := 0; i < 500; i++ {
+			now = now.Add(10 * time.Millisecond)
+			m.add(1000, now)
+		}
+		assert.InEpsilon(t, 100_000, m.rate(now), 0.05)
+
+		// no traffic decays the rate towards zero
+		assert.Less(t, m.rate(now.Add(10*time.Second)), 10.0)
+	})
+
+	t.Run("Conn", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r, WithRateWindow(time.Second))
+		defer conn.Close()
+
+		w.Write(makeSuccessFrame(randomString()))
+		go func() {
+			w.Write(makeDataFrame(testData))
+			io.Copy(io.Discard, w)
+		}()
+
+		buf := make([]byte, len(testData))
+		_, err := io.ReadFull(conn, buf)
+		assert.NoError(t, err)
+
+		_, err = conn.Write(testData)
+		assert.NoError(t, err)
+
+		// the read loop counts received data after handing it to Read
+		assert.Eventually(t, func() bool {
+			return conn.Stats().RecvRate > 0
+		}, time.Second, time.Millisecond)
+		assert.Greater(t, conn.Stats().SendRate, 0.0)
+	})
+
+	t.Run("Recv backlog", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r, WithRecvBufferCapacity(100))
+		defer conn.Close()
+
+		data := make([]byte, 300)
+		for i := range data {
+			data[i] = byte(i)
+		}
+
+		w.Write(makeSuccessFrame(randomString()))
+		go func() {
+			for i := 0; i < len(data); i += 30 {
+				w.Write(makeDataFrame(data[i : i+30]))
+			}
+			io.Copy(io.Discard, w)
+		}()
+
+		// nothing is reading, so the backlog fills up
+		assert.Eventually(t, func() bool {
+			return conn.Stats().RecvBacklog == 100
+		}, time.Second, time.Millisecond)
+		assert.Equal(t, 100, conn.Stats().RecvBacklogCap)
+
+		buf := make([]byte, len(data))
+		_, err := io.ReadFull(conn, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, data, buf)
+		assert.Zero(t, conn.Stats().RecvBacklog)
+	})
+}
+
+func TestRecvBuffer(t *testing.T) {
+	t.Run("Slow reader", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r, WithReconnect(), WithRecvBufferCapacity(1024))
+		defer conn.Close()
+
+		w.Write(makeSuccessFrame(randomString()))
+		go io.Copy(io.Discard, w)
+
+		_, err := conn.Write([]byte("ping"))
+		assert.NoError(t, err)
+
+		// nothing reads the data, but the ack behind it is still processed
+		w.Write(makeDataFrame(testData))
+		w.Write(makeAckFrame(uint64(len("ping"))))
+		assert.Eventually(t, func() bool {
+			return conn.Sent() == uint64(len("ping"))
+		}, time.Second, time.Millisecond)
+
+		buf := make([]byte, len(testData))
+		_, err = io.ReadFull(conn, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, testData, buf)
+	})
+
+	for _, capacity := range []int{0, 100, subprotoMaxFrameSize} {
+		t.Run(fmt.Sprintf("Fast reader with capacity %d", capacity), func(t *testing.T) {
+			r, w := net.Pipe()
+			defer w.Close()
+
+			conn := NewConn(r, WithRecvBufferCapacity(capacity))
+			defer conn.Close()
+
+			data := make([]byte, 256*1024)
+			rand.Read(data)
+
+			w.Write(makeSuccessFrame(randomString()))
+			go io.Copy(io.Discard, w)
+			go func() {
+				for sent := 0; sent < len(data); {
+					n := min(len(data)-sent, 1+sent%subprotoMaxFrameSize)
+					w.Write(makeDataFrame(data[sent : sent+n]))
+					sent += n
+				}
+			}()
+
+			// reads of varying sizes that don't line up with the frames
+			var buf []byte
+			for i := 1; len(buf) < len(data); i++ {
+				chunk := make([]byte, min(len(data)-len(buf), i*97%5000+1))
+				n, err := conn.Read(chunk)
+				if !assert.NoError(t, err) {
+					return
+				}
+				buf = append(buf, chunk[:n]...)
+			}
+			assert.Equal(t, data, buf)
+		})
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	closeReasonOf := func(conn *Conn) CloseReason {
+		assert.Eventually(t, func() bool {
+			return conn.Err() != nil
+		}, time.Second, time.Millisecond)
+		return conn.Stats().CloseReason
+	}
+
+	t.Run("Open", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r)
+		defer conn.Close()
+
+		assert.Equal(t, CloseReasonNone, conn.Stats().CloseReason)
+	})
+
+	t.Run("Local", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r)
+		conn.Close()
+
+		assert.Equal(t, CloseReasonLocal, closeReasonOf(conn))
+	})
+
+	t.Run("EOF", func(t *testing.T) {
+		r, w := net.Pipe()
+
+		conn := NewConn(r)
+		defer conn.Close()
+
+		w.Write(makeSuccessFrame(randomString()))
+		w.Close()
+
+		assert.Equal(t, CloseReasonEOF, closeReasonOf(conn))
+	})
+
+	t.Run("Protocol", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r)
+		defer conn.Close()
+
+		go w.Write(makeDataFrame(testData))
+
+		assert.Equal(t, CloseReasonProtocol, closeReasonOf(conn))
+		assert.Equal(t, ErrNoSuccessFrame.Error(), conn.Stats().CloseDetail)
+	})
+
+	t.Run("Idle timeout", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(r, WithIdleTimeout(10*time.Millisecond))
+		defer conn.Close()
+
+		assert.Equal(t, CloseReasonIdleTimeout, closeReasonOf(conn))
+	})
+
+	t.Run("Lifetime", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		conn := NewConn(r, WithLifetimeContext(ctx))
+		defer conn.Close()
+
+		assert.Equal(t, CloseReasonLifetime, closeReasonOf(conn))
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer w.Close()
+
+		conn := NewConn(&failingConn{Conn: r})
+		defer conn.Close()
+
+		go io.Copy(io.Discard, w)
+		conn.Write(testData)
+
+		assert.Equal(t, CloseReasonError, closeReasonOf(conn))
+	})
+}
+
+func TestConnectURL(t *testing.T) {
+	url := connectURL(&dialOptions{
+		Zone:    "zone",
+		Region:  "region",
+		Project: "project",
+	})
+
+	assert.Contains(t, url, proxyHost)
+	assert.Contains(t, url, connectPath(defaultProtocolVersion))
+
+	assert.Contains(t, url, "zone=zone")
+	assert.Contains(t, url, "region=region")
+	assert.Contains(t, url, "project=project")
+
+	assert.NotContains(t, url, "token=")
+	assert.NotContains(t, url, "group=")
+	assert.NotContains(t, url, "port=")
+
+	t.Run("With connect params", func(t *testing.T) {
+		dopts := &dialOptions{}
+		dopts.collectOpts([]DialOption{
+			WithProject("project"),
+			WithPort("22"),
+			WithConnectParam("newDimension", "value"),
+			WithConnectParam("port", "2222"),
+			WithConnectParam("empty", ""),
+		})
+		url := connectURL(dopts)
+
+		assert.Contains(t, url, "project=project")
+		assert.Contains(t, url, "newDimension=value")
+		assert.Contains(t, url, "port=2222")
+		assert.Equal(t, 1, strings.Count(url, "port="))
+		assert.NotContains(t, url, "empty=")
+	})
+
+	t.Run("With protocol version", func(t *testing.T) {
+		dopts := &dialOptions{}
+		dopts.collectOpts([]DialOption{WithProject("project"), WithProtocolVersion(4)})
+		assert.NoError(t, dopts.validate())
+
+		connect := connectURL(dopts)
+		assert.Contains(t, connect, "/v4/connect?")
+
+		reconnect, err := reconnectURL(connect, dopts, "sid", 0)
+		assert.NoError(t, err)
+		assert.Contains(t, reconnect, "/v4/reconnect?")
+
+		// both paths follow the version, though only 4 can be dialed
+		dopts.ProtocolVersion = 5
+		assert.Contains(t, connectURL(dopts), "/v5/connect?")
+		reconnect, err = reconnectURL(connect, dopts, "sid", 0)
+		assert.NoError(t, err)
+		assert.Contains(t, reconnect, "/v5/reconnect?")
+
+		var configError *ConfigError
+		assert.ErrorAs(t, dopts.validate(), &configError)
+
+		dopts.ProtocolVersion = 0
+		assert.Contains(t, connectURL(dopts), "/v4/connect")
+	})
+}
+
+func BenchmarkConn(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		r, w := net.Pipe()
+		conn := NewConn(r)
+		conn.Close()
+		w.Close()
+	}
+}
+
+// countingConn counts writes to the relay.
+// shortConn is a conn whose ReadFrom consumes everything but only writes 3 bytes.
+type shortConn struct {
+	net.Conn
+}
+
+func (shortConn) ReadFrom(r io.Reader) (int64, error) {
+	io.Copy(io.Discard, r)
+	return 3, io.ErrShortWrite
+}
+
+type countingConn struct {
+	net.Conn
+	writes atomic.Int64
+}
+
+func (c *countingConn) Write(buf []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(buf)
+}
+
+func BenchmarkRead(b *testing.B) {
+	b.Run("Direct", func(b *testing.B) {
+		benchmarkRead(b)
+	})
+
+	b.Run("Recv buffer", func(b *testing.B) {
+		benchmarkRead(b, WithRecvBufferCapacity(4*subprotoMaxFrameSize))
+	})
+}
+
+func benchmarkRead(b *testing.B, opts ...DialOption) {
+	r, w := net.Pipe()
+	defer w.Close()
+
+	conn := NewConn(r, opts...)
+	defer conn.Close()
+
+	frame := makeDataFrame(make([]byte, subprotoMaxFrameSize))
+
+	go io.Copy(io.Discard, w)
+	go func() {
+		w.Write(makeSuccessFrame(randomString()))
+		for i := 0; i < b.N; i++ {
+			if _, err := w.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, subprotoMaxFrameSize)
+
+	b.ReportAllocs()
+	b.SetBytes(subprotoMaxFrameSize)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCopy(b *testing.B) {
+	b.Run("ReadFrom", func(b *testing.B) {
+		benchmarkCopy(b, func(conn *Conn, r io.Reader) {
+			io.Copy(conn, r)
+		})
+	})
+
+	b.Run("Without ReadFrom", func(b *testing.B) {
+		// hide ReadFrom so io.Copy uses its own buffer, as it did before
+		benchmarkCopy(b, func(conn *Conn, r io.Reader) {
+			io.Copy(struct{ io.Writer }{conn}, r)
+		})
+	})
+}
+
+func benchmarkCopy(b *testing.B, copy func(*Conn, io.Reader)) {
+	r, w := net.Pipe()
+	defer w.Close()
+
+	conn := NewConn(r)
+	defer conn.Close()
+
+	go io.Copy(io.Discard, w)
+
+	const size = 1 << 20
+
+	b.ReportAllocs()
+	b.SetBytes(size)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		copy(conn, io.LimitReader(zeroReader{}, size))
+	}
+}
+
+// zeroReader is an endless stream of zeros that doesn't implement io.WriterTo.
+type zeroReader struct{}
+
+func (zeroReader) Read(buf []byte) (int, error) {
+	clear(buf)
+	return len(buf), nil
+}
+
+func BenchmarkReadBufferSize(b *testing.B) {
+	// small reads, as made by a parser reading a stream a few bytes at a time
+	for _, size := range []int{0, 4096, subprotoMaxFrameSize} {
+		b.Run(fmt.Sprintf("Size %d", size), func(b *testing.B) {
+			benchmarkSmallReads(b, 16, WithReadBufferSize(size))
+		})
+	}
+}
+
+func benchmarkSmallReads(b *testing.B, size int, opts ...DialOption) {
+	r, w := net.Pipe()
+	defer w.Close()
+
+	conn := NewConn(r, opts...)
+	defer conn.Close()
+
+	frame := makeDataFrame(make([]byte, subprotoMaxFrameSize))
+
+	go io.Copy(io.Discard, w)
+	go func() {
+		w.Write(makeSuccessFrame(randomString()))
+		for {
+			if _, err := w.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, size)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteBufferSize(b *testing.B) {
+	// coalesced small writes are sent when the buffer fills
+	for _, size := range []int{1024, subprotoMaxFrameSize, subprotoMaxBatchFrames * subprotoMaxFrameSize} {
+		b.Run(fmt.Sprintf("Size %d", size), func(b *testing.B) {
+			benchmarkWrite(b, 256, WithWriteCoalesce(time.Hour), WithWriteBufferSize(size))
+		})
+	}
+}
+
+// benchmarkRetainedWrite is benchmarkWrite with WithReconnect, and a relay that acks
+// every frame so the send window doesn't fill.
+func benchmarkRetainedWrite(b *testing.B, size int) {
+	r, w := net.Pipe()
+	defer w.Close()
+
+	counting := &countingConn{Conn: r}
+	conn := NewConn(counting, WithReconnect())
+	defer conn.Close()
+
+	go func() {
+		header := make([]byte, 6)
+		body := make([]byte, subprotoMaxFrameSize)
+		var received uint64
+
+		w.Write(makeSuccessFrame(randomString()))
+		for {
+			if _, err := io.ReadFull(w, header); err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(header[2:6])
+			if _, err := io.ReadFull(w, body[:n]); err != nil {
+				return
+			}
+			received += uint64(n)
+			w.Write(makeAckFrame(received))
+		}
+	}()
+
+	buf := make([]byte, size)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		conn.Write(buf)
+	}
+
+	b.ReportMetric(float64(counting.writes.Load())/float64(b.N), "writes/op")
+}
+
+func benchmarkWrite(b *testing.B, size int, opts ...DialOption) {
+	r, w := net.Pipe()
+	defer w.Close()
+
+	counting := &countingConn{Conn: r}
+	conn := NewConn(counting, opts...)
+	defer conn.Close()
+
+	go io.Copy(io.Discard, w)
+
+	buf := make([]byte, size)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		conn.Write(buf)
+	}
+	conn.Flush()
+
+	b.ReportMetric(float64(counting.writes.Load())/float64(b.N), "writes/op")
+}
+
+func BenchmarkWrite(b *testing.B) {
+	b.Run("Without coalescing", func(b *testing.B) {
+		benchmarkWrite(b, 1)
+	})
+
+	b.Run("With coalescing", func(b *testing.B) {
+		benchmarkWrite(b, 1, WithWriteCoalesce(time.Millisecond))
+	})
+
+	b.Run("Frame sized", func(b *testing.B) {
+		// the frame is built in the write buffer, so nothing is allocated
+		benchmarkWrite(b, subprotoMaxFrameSize)
+	})
+
+	b.Run("Large", func(b *testing.B) {
+		// the batch is built in a pooled buffer, so nothing is allocated
+		benchmarkWrite(b, subprotoMaxBatchFrames*subprotoMaxFrameSize)
+	})
+
+	b.Run("Large with reconnect", func(b *testing.B) {
+		benchmarkRetainedWrite(b, subprotoMaxBatchFrames*subprotoMaxFrameSize)
+	})
+
+	b.Run("Large with coalescing", func(b *testing.B) {
+		// coalescing sends each frame with its own write, for comparison
+		benchmarkWrite(b, subprotoMaxBatchFrames*subprotoMaxFrameSize, WithWriteCoalesce(time.Millisecond))
+	})
 }
@@ -0,0 +1,58 @@
+package iap
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const defaultKeepAliveMissedLimit = 2
+
+// keepAlive pings the relay every interval without received data, closing the
+// connection once more than missedLimit pongs in a row are missed.
+func (c *Conn) keepAlive(interval time.Duration, missedLimit int) {
+	ticker := c.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	var missed int
+	received := c.received()
+
+	for {
+		select {
+		case <-ticker.C():
+		case <-c.ctx.Done():
+			return
+		}
+
+		// received data shows the relay is alive, and pongs can't be read while the
+		// read loop waits for a frame to be read anyway
+		if now := c.received(); now != received || c.recvPipe.delivering.Load() {
+			received = now
+			missed = 0
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(c.ctx, interval)
+		_, err := c.Ping(ctx)
+		cancel()
+
+		switch {
+		case err == nil:
+			missed = 0
+		case errors.Is(err, errors.ErrUnsupported), c.ctx.Err() != nil:
+			return
+		default:
+			if missed++; missed > missedLimit {
+				c.closeWithError(ErrKeepAliveTimeout)
+				return
+			}
+		}
+	}
+}
+
+// received returns the number of bytes received so far.
+func (c *Conn) received() uint64 {
+	c.ackMu.Lock()
+	defer c.ackMu.Unlock()
+	return c.recvNbUnacked
+}
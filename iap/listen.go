@@ -0,0 +1,142 @@
+package iap
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const listenRetryBackoff = time.Second
+
+var _ net.Listener = (*Listener)(nil)
+
+// Listener accepts connections initiated by the destination.
+//
+// IAP only supports tunnels dialed by the client, so the Listener keeps a number of
+// tunnels dialed ahead of time and waiting for the destination to write. A tunnel is
+// accepted once the first bytes arrive from the destination and is then replaced by a
+// new one. This means the process at the destination must speak first on connections
+// it wants to initiate, and keeps one idle TCP connection open per waiting tunnel.
+type Listener struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	addr   net.Addr
+	clock  clock
+	wg     sync.WaitGroup
+
+	acceptCh chan *Conn
+}
+
+// Listen starts keeping backlog tunnels to the destination waiting for connections
+// initiated from the other side.
+func Listen(ctx context.Context, backlog int, opts ...DialOption) (*Listener, error) {
+	if backlog < 1 {
+		return nil, &ConfigError{"backlog must be at least 1"}
+	}
+
+	dopts := &dialOptions{}
+	dopts.collectOpts(opts)
+
+	if err := dopts.validate(); err != nil {
+		return nil, err
+	}
+	if err := dopts.resolveLocation(ctx); err != nil {
+		return nil, err
+	}
+
+	l := &Listener{
+		addr:     addr(connectURL(dopts)),
+		clock:    dopts.Clock,
+		acceptCh: make(chan *Conn),
+	}
+	if l.clock == nil {
+		l.clock = realClock{}
+	}
+	l.ctx, l.cancel = context.WithCancel(ctx)
+
+	l.wg.Add(backlog)
+	for i := 0; i < backlog; i++ {
+		go l.wait(opts)
+	}
+
+	return l, nil
+}
+
+// wait repeatedly dials a tunnel and hands it to Accept once the destination writes to it.
+func (l *Listener) wait(opts []DialOption) {
+	defer l.wg.Done()
+
+	for l.ctx.Err() == nil {
+		conn, err := l.waitConn(opts)
+		if err != nil {
+			timer := l.clock.NewTimer(listenRetryBackoff)
+			select {
+			case <-timer.C():
+			case <-l.ctx.Done():
+				timer.Stop()
+			}
+			continue
+		}
+
+		select {
+		case l.acceptCh <- conn:
+		case <-l.ctx.Done():
+			conn.Close()
+		}
+	}
+}
+
+func (l *Listener) waitConn(opts []DialOption) (*Conn, error) {
+	// the dial context bounds the lifetime of the tunnel, so it must outlive
+	// the listener once the tunnel is accepted
+	dialCtx, cancel := context.WithCancel(context.WithoutCancel(l.ctx))
+	stopCancel := context.AfterFunc(l.ctx, cancel)
+
+	conn, err := Dial(dialCtx, opts...)
+	stopCancel()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// unblock Peek if the listener is closed while waiting
+	stopClose := context.AfterFunc(l.ctx, func() {
+		conn.Close()
+	})
+
+	_, err = conn.Peek(1)
+	if !stopClose() {
+		err = net.ErrClosed
+	}
+	if err != nil {
+		conn.Close()
+		cancel()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// Accept waits for and returns the next connection initiated by the destination.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.acceptCh:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections and closes the waiting tunnels. Connections
+// already accepted are not closed.
+func (l *Listener) Close() error {
+	l.cancel()
+	l.wg.Wait()
+	return nil
+}
+
+// Addr returns the destination of the listener's tunnels.
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
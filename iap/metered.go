@@ -0,0 +1,246 @@
+package iap
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MeteredConn wraps a net.Conn, usually a *Conn, and counts the bytes read and
+// written through it and when it was last used. Conn's own counters only include
+// data the relay has acked, so these are for when the volume handed to the caller
+// matters, or for counting a layer above the tunnel. It can also limit the rate
+// data is read and written with SetRateLimit. It can be passed to anything that
+// takes a net.Conn.
+type MeteredConn struct {
+	net.Conn
+
+	read         atomic.Uint64
+	written      atomic.Uint64
+	lastActivity atomic.Int64
+
+	clock        clock
+	limitMu      sync.Mutex
+	readLimiter  *rateLimiter
+	writeLimiter *rateLimiter
+
+	// deadlines are kept to stop waiting for the rate limit once they'd pass
+	readDeadline  atomic.Int64
+	writeDeadline atomic.Int64
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewMeteredConn returns a MeteredConn that counts traffic through conn.
+func NewMeteredConn(conn net.Conn) *MeteredConn {
+	return &MeteredConn{
+		Conn:   conn,
+		clock:  realClock{},
+		closed: make(chan struct{}),
+	}
+}
+
+// SetRateLimit limits the data read and the data written to bytesPerSec each, with
+// bursts of up to a frame. Read and Write block while over the limit, and fail with
+// os.ErrDeadlineExceeded rather than wait past their deadline. A bytesPerSec of 0
+// removes the limit, which is the default.
+func (m *MeteredConn) SetRateLimit(bytesPerSec int) {
+	m.limitMu.Lock()
+	defer m.limitMu.Unlock()
+
+	if bytesPerSec <= 0 {
+		m.readLimiter, m.writeLimiter = nil, nil
+		return
+	}
+	now := m.clock.Now()
+	m.readLimiter = newRateLimiter(bytesPerSec, now)
+	m.writeLimiter = newRateLimiter(bytesPerSec, now)
+}
+
+func (m *MeteredConn) Read(b []byte) (int, error) {
+	if burst := m.burst(&m.readLimiter); burst > 0 && len(b) > burst {
+		b = b[:burst]
+	}
+
+	n, err := m.Conn.Read(b)
+	m.countRead(n)
+	if n > 0 {
+		// the data is already read, so the wait is taken before handing it over
+		if werr := m.waitRateLimit(&m.readLimiter, n, &m.readDeadline); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (m *MeteredConn) Write(b []byte) (int, error) {
+	burst := m.burst(&m.writeLimiter)
+	if burst == 0 {
+		n, err := m.Conn.Write(b)
+		m.countWritten(n)
+		return n, err
+	}
+
+	var written int
+	for written < len(b) {
+		chunk := b[written:min(len(b), written+burst)]
+		if err := m.waitRateLimit(&m.writeLimiter, len(chunk), &m.writeDeadline); err != nil {
+			return written, err
+		}
+
+		n, err := m.Conn.Write(chunk)
+		m.countWritten(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// ReadFrom uses the ReadFrom of the wrapped conn if it has one and there's no rate
+// limit, so io.Copy is as fast as without the wrapper. Data is counted once the
+// wrapped ReadFrom returns, since only then is it known how much was written.
+func (m *MeteredConn) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := m.Conn.(io.ReaderFrom); ok && m.burst(&m.writeLimiter) == 0 {
+		n, err := rf.ReadFrom(r)
+		m.countWritten(int(n))
+		return n, err
+	}
+	// hide ReadFrom so io.Copy doesn't call it again
+	return io.Copy(struct{ io.Writer }{m}, r)
+}
+
+// WriteTo uses the WriteTo of the wrapped conn if it has one and there's no rate
+// limit, so io.Copy is as fast as without the wrapper. Data is counted as w accepts
+// it.
+func (m *MeteredConn) WriteTo(w io.Writer) (int64, error) {
+	if wt, ok := m.Conn.(io.WriterTo); ok && m.burst(&m.readLimiter) == 0 {
+		return wt.WriteTo(writerFunc(func(b []byte) (int, error) {
+			n, err := w.Write(b)
+			m.countRead(n)
+			return n, err
+		}))
+	}
+	// hide WriteTo so io.Copy doesn't call it again
+	return io.Copy(w, struct{ io.Reader }{m})
+}
+
+func (m *MeteredConn) SetDeadline(t time.Time) error {
+	m.readDeadline.Store(deadlineNanos(t))
+	m.writeDeadline.Store(deadlineNanos(t))
+	return m.Conn.SetDeadline(t)
+}
+
+func (m *MeteredConn) SetReadDeadline(t time.Time) error {
+	m.readDeadline.Store(deadlineNanos(t))
+	return m.Conn.SetReadDeadline(t)
+}
+
+func (m *MeteredConn) SetWriteDeadline(t time.Time) error {
+	m.writeDeadline.Store(deadlineNanos(t))
+	return m.Conn.SetWriteDeadline(t)
+}
+
+// Close closes the wrapped conn, stopping any wait for the rate limit.
+func (m *MeteredConn) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+	})
+	return m.Conn.Close()
+}
+
+// burst returns the most data the limiter at l lets through at once, or 0 if there
+// is no limit.
+func (m *MeteredConn) burst(l **rateLimiter) int {
+	m.limitMu.Lock()
+	defer m.limitMu.Unlock()
+
+	if *l == nil {
+		return 0
+	}
+	return int((*l).burst)
+}
+
+// waitRateLimit blocks until n more bytes are allowed by the limiter at l. It fails
+// straight away if the wait would pass deadline.
+func (m *MeteredConn) waitRateLimit(l **rateLimiter, n int, deadline *atomic.Int64) error {
+	m.limitMu.Lock()
+	limiter := *l
+	if limiter == nil {
+		m.limitMu.Unlock()
+		return nil
+	}
+	wait := limiter.reserve(n, m.clock.Now())
+	m.limitMu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	if nanos := deadline.Load(); nanos != 0 && time.Until(time.Unix(0, nanos)) < wait {
+		m.limitMu.Lock()
+		limiter.cancel(n)
+		m.limitMu.Unlock()
+		return os.ErrDeadlineExceeded
+	}
+
+	timer := m.clock.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C():
+		return nil
+	case <-m.closed:
+		return net.ErrClosed
+	}
+}
+
+func (m *MeteredConn) countRead(n int) {
+	if n > 0 {
+		m.read.Add(uint64(n))
+		m.lastActivity.Store(m.clock.Now().UnixNano())
+	}
+}
+
+func (m *MeteredConn) countWritten(n int) {
+	if n > 0 {
+		m.written.Add(uint64(n))
+		m.lastActivity.Store(m.clock.Now().UnixNano())
+	}
+}
+
+// BytesRead returns the number of bytes read from the conn.
+func (m *MeteredConn) BytesRead() uint64 {
+	return m.read.Load()
+}
+
+// BytesWritten returns the number of bytes written to the conn.
+func (m *MeteredConn) BytesWritten() uint64 {
+	return m.written.Load()
+}
+
+// LastActivity returns when data was last read or written, or the zero time if
+// none has been.
+func (m *MeteredConn) LastActivity() time.Time {
+	nanos := m.lastActivity.Load()
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// deadlineNanos returns t as Unix nanoseconds, or 0 for no deadline.
+func deadlineNanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) { return f(b) }
@@ -0,0 +1,385 @@
+package iap
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// deadline is a resettable deadline that closes a channel when it passes,
+// like the one used by net.Pipe.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+// set sets the deadline. A zero time means no deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// the timer already fired, wait for it to close cancel
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// isSet reports whether a deadline is set, including one that has passed.
+func (d *deadline) isSet() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.timer != nil || isClosedChan(d.cancel)
+}
+
+// wait returns a channel that is closed when the deadline passes.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// pipe hands received data to readers. A Read passes its buffer to the read loop,
+// which fills it straight from the relay, so data is copied once on the way in.
+// A Read with a deadline can't let the read loop fill its buffer, as the relay might
+// not send the rest of a frame before the deadline, so the loop fills a buffer of its
+// own for it instead, which goes to the next Read if this one times out. With a
+// backlog, the read loop instead fills the backlog and only waits for readers once
+// it is full.
+type pipe struct {
+	wrMu    sync.Mutex
+	rdBufCh chan pipeRead
+	rdResCh chan int
+
+	pendingMu sync.Mutex
+	pending   []byte
+	pendingCh chan struct{}
+	scratch   []byte
+
+	// delivering is set while the read loop is handing a frame to readers
+	delivering atomic.Bool
+
+	backlogMu sync.Mutex
+	backlog   *ringBuffer
+	dataCh    chan struct{}
+	spaceCh   chan struct{}
+
+	once sync.Once
+	done chan struct{}
+	err  error
+
+	readDeadline *deadline
+}
+
+func newPipe(backlog int) *pipe {
+	p := &pipe{
+		rdBufCh:      make(chan pipeRead),
+		rdResCh:      make(chan int),
+		pendingCh:    make(chan struct{}, 1),
+		done:         make(chan struct{}),
+		readDeadline: newDeadline(),
+	}
+	if backlog > 0 {
+		p.backlog = newRingBuffer(backlog)
+		p.dataCh = make(chan struct{}, 1)
+		p.spaceCh = make(chan struct{}, 1)
+	}
+	return p
+}
+
+// backlogLen returns how many bytes are buffered in the backlog and its capacity.
+func (p *pipe) backlogLen() (int, int) {
+	if p.backlog == nil {
+		return 0, 0
+	}
+
+	p.backlogMu.Lock()
+	defer p.backlogMu.Unlock()
+	return p.backlog.Len(), p.backlog.Cap()
+}
+
+// pipeRead is a Read waiting for data. Without copy, the read loop fills b and
+// sends the number of bytes on rdResCh. With copy, it fills the pending buffer.
+type pipeRead struct {
+	b    []byte
+	copy bool
+}
+
+// Read waits for data to be written into b.
+func (p *pipe) Read(b []byte) (int, error) {
+	select {
+	case <-p.done:
+		return 0, p.err
+	case <-p.readDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if p.backlog != nil {
+		return p.readBacklog(b)
+	}
+
+	for {
+		if n := p.readPending(b); n > 0 {
+			return n, nil
+		}
+
+		deadline := p.readDeadline.wait()
+		read := pipeRead{b: b, copy: p.readDeadline.isSet()}
+
+		select {
+		case p.rdBufCh <- read:
+		case <-p.pendingCh:
+			// the loop finished reading for a Read that timed out
+			continue
+		case <-p.done:
+			return 0, p.err
+		case <-deadline:
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		if !read.copy {
+			// the loop reads nothing if the relay fails, in which case the pipe is
+			// about to be closed
+			if n := <-p.rdResCh; n > 0 {
+				return n, nil
+			}
+			continue
+		}
+
+		select {
+		case <-p.pendingCh:
+		case <-p.done:
+		case <-deadline:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// readPending reads data the read loop read for an earlier Read into b.
+func (p *pipe) readPending(b []byte) int {
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n
+}
+
+// readBacklog reads buffered data into b, waiting for some if there is none. Data
+// that was buffered before the pipe was closed can still be read.
+func (p *pipe) readBacklog(b []byte) (int, error) {
+	for {
+		p.backlogMu.Lock()
+		n := p.backlog.Read(b)
+		more := p.backlog.Len() > 0
+		p.backlogMu.Unlock()
+
+		if n > 0 {
+			signal(p.spaceCh)
+			// wake any other reader for what's left
+			if more {
+				signal(p.dataCh)
+			}
+			return n, nil
+		}
+
+		select {
+		case <-p.dataCh:
+		case <-p.done:
+			// data may have been buffered just before closing
+			if buffered, _ := p.backlogLen(); buffered > 0 {
+				continue
+			}
+			return 0, p.err
+		case <-p.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// readFrom reads n bytes from r into the buffers of waiting readers.
+func (p *pipe) readFrom(r io.Reader, n int) (int, error) {
+	p.wrMu.Lock()
+	defer p.wrMu.Unlock()
+
+	p.delivering.Store(true)
+	defer p.delivering.Store(false)
+
+	if p.backlog != nil {
+		return p.readFromBacklog(r, n)
+	}
+
+	var written int
+	for written < n {
+		select {
+		case read := <-p.rdBufCh:
+			// data left for a Read that timed out comes first, and must be read
+			// before the buffer it's in is filled again
+			if !read.copy {
+				if nr := p.readPending(read.b); nr > 0 {
+					p.rdResCh <- nr
+					continue
+				}
+			} else if p.hasPending() {
+				signal(p.pendingCh)
+				continue
+			}
+
+			nr, err := p.readInto(r, read, n-written)
+			written += nr
+
+			if err == io.EOF && written < n {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil && written < n {
+				return written, err
+			}
+		case <-p.done:
+			return written, io.ErrClosedPipe
+		}
+	}
+
+	return written, nil
+}
+
+// readInto reads up to n bytes from r for read, either into its buffer or the
+// pending buffer.
+func (p *pipe) readInto(r io.Reader, read pipeRead, n int) (int, error) {
+	if !read.copy {
+		nr, err := r.Read(read.b[:min(len(read.b), n)])
+		p.rdResCh <- nr
+		return nr, err
+	}
+
+	if p.scratch == nil {
+		p.scratch = getFrameBuf()
+	}
+	nr, err := r.Read(p.scratch[:min(len(read.b), subprotoMaxFrameSize, n)])
+
+	p.pendingMu.Lock()
+	p.pending = p.scratch[:nr]
+	p.pendingMu.Unlock()
+	signal(p.pendingCh)
+
+	return nr, err
+}
+
+// release returns the scratch buffer to the pool, dropping anything pending in it.
+// The read loop must have stopped.
+func (p *pipe) release() {
+	p.pendingMu.Lock()
+	buf := p.scratch
+	p.scratch, p.pending = nil, nil
+	p.pendingMu.Unlock()
+
+	if buf != nil {
+		putFrameBuf(buf)
+	}
+}
+
+func (p *pipe) hasPending() bool {
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+	return len(p.pending) > 0
+}
+
+// readFromBacklog reads n bytes from r into the backlog, waiting for readers to make
+// space when it's full.
+func (p *pipe) readFromBacklog(r io.Reader, n int) (int, error) {
+	var written int
+	for written < n {
+		p.backlogMu.Lock()
+		// only this goroutine writes to the backlog, so the free space stays free
+		// while it's filled without the lock
+		free := p.backlog.Available()
+		p.backlogMu.Unlock()
+
+		if len(free) == 0 {
+			select {
+			case <-p.spaceCh:
+				continue
+			case <-p.done:
+				return written, io.ErrClosedPipe
+			}
+		}
+
+		nr, err := r.Read(free[:min(len(free), n-written)])
+
+		p.backlogMu.Lock()
+		p.backlog.Commit(nr)
+		p.backlogMu.Unlock()
+		signal(p.dataCh)
+		written += nr
+
+		if err == io.EOF && written < n {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil && written < n {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// signal wakes a goroutine waiting on c without blocking.
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// CloseWithError closes the pipe so reads return err, or io.EOF if err is nil.
+func (p *pipe) CloseWithError(err error) {
+	p.once.Do(func() {
+		if err == nil {
+			err = io.EOF
+		}
+		p.err = err
+		close(p.done)
+	})
+}
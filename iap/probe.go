@@ -0,0 +1,62 @@
+package iap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// relay close codes seen when the tunnel can't be established
+const (
+	closeCodeBackendUnreachable = 4003
+	closeCodeNotAuthorized      = 4033
+	closeCodeNotFound           = 4047
+)
+
+// Probe dials the relay, waits for the connection to be established and closes it.
+// It returns nil if the destination is reachable, otherwise an error wrapping one of
+// ErrUnauthorized, ErrNotFound or ErrUnreachable where the cause is known.
+func Probe(ctx context.Context, opts ...DialOption) error {
+	conn, err := Dial(ctx, opts...)
+	if err != nil {
+		return classifyError(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WaitConnected(ctx); err != nil {
+		return classifyError(err)
+	}
+
+	return nil
+}
+
+func classifyError(err error) error {
+	var handshakeError *HandshakeError
+	var closeError *CloseError
+	var netError net.Error
+
+	switch {
+	case errors.As(err, &handshakeError):
+		switch handshakeError.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return fmt.Errorf("%w: %w", ErrUnauthorized, err)
+		case http.StatusNotFound:
+			return fmt.Errorf("%w: %w", ErrNotFound, err)
+		}
+	case errors.As(err, &closeError):
+		switch closeError.Code {
+		case closeCodeNotAuthorized:
+			return fmt.Errorf("%w: %w", ErrUnauthorized, err)
+		case closeCodeNotFound:
+			return fmt.Errorf("%w: %w", ErrNotFound, err)
+		case closeCodeBackendUnreachable:
+			return fmt.Errorf("%w: %w", ErrUnreachable, err)
+		}
+	case errors.As(err, &netError):
+		return fmt.Errorf("%w: %w", ErrUnreachable, err)
+	}
+
+	return err
+}
@@ -0,0 +1,76 @@
+package iap
+
+import (
+	"os"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting data to a number of bytes per second. It
+// isn't locked: a Conn only uses it from the write loop, and a MeteredConn locks it.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a rateLimiter that starts full, allowing a burst of up to a
+// frame or a second's worth of data, whichever is smaller.
+func newRateLimiter(bytesPerSec int, now time.Time) *rateLimiter {
+	burst := float64(min(bytesPerSec, subprotoMaxFrameSize))
+	return &rateLimiter{
+		rate:   float64(bytesPerSec),
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait before sending
+// them. The bucket can go into debt, so sends larger than the burst still go through
+// once enough time has passed.
+func (l *rateLimiter) reserve(n int, now time.Time) time.Duration {
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// cancel returns n bytes reserved but not sent to the bucket.
+func (l *rateLimiter) cancel(n int) {
+	l.tokens += float64(n)
+}
+
+// waitRateLimit blocks until n more bytes can be sent under WithRateLimit. Waiting
+// stops with os.ErrDeadlineExceeded once the current Write is aborted.
+func (c *Conn) waitRateLimit(n int) error {
+	if c.sendLimiter == nil {
+		return nil
+	}
+
+	wait := c.sendLimiter.reserve(n, c.clock.Now())
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := c.clock.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C():
+			return nil
+		case <-c.sendAbortCh:
+			if c.isSendAborted() {
+				c.sendLimiter.cancel(n)
+				return os.ErrDeadlineExceeded
+			}
+		case <-c.ctx.Done():
+			return c.Err()
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package iap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+const (
+	maxReconnectAttempts = 3
+	reconnectBackoff     = 100 * time.Millisecond
+
+	minSendWindow = subprotoAckThreshold + subprotoMaxFrameSize
+	maxSendWindow = 64 << 20
+)
+
+func reconnectURL(connectURL string, dopts *dialOptions, sessionID string, ack uint64) (string, error) {
+	u, err := url.Parse(connectURL)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{
+		"sid": []string{sessionID},
+		"ack": []string{strconv.FormatUint(ack, 10)},
+	}
+	if dopts.Zone != "" {
+		query.Set("zone", dopts.Zone)
+	} else if dopts.Region != "" {
+		query.Set("region", dopts.Region)
+	}
+
+	u.Path = reconnectPath(dopts.protocolVersion())
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// ackSent records that the relay has received nb bytes from us and
+// discards any retained data it covers. An ack of fewer bytes than an earlier one
+// is handled as set by WithAckRegressionMode, except for the ack of a reconnect,
+// when the data it no longer covers may have been discarded already, so it's
+// always an error.
+func (c *Conn) ackSent(nb uint64, reconnect bool) error {
+	c.sendMu.Lock()
+	if nb < c.sendNbAcked {
+		acked := c.sendNbAcked
+		c.sendMu.Unlock()
+
+		if reconnect || c.dopts.AckRegression == AckRegressionError {
+			return newAckRegressionError(nb, acked)
+		}
+		return nil
+	}
+	if c.sendUnacked != nil && nb > c.sendNbAcked {
+		c.sendUnacked.Discard(int(min(nb-c.sendNbAcked, uint64(c.sendUnacked.Len()))))
+	}
+	c.sendNbAcked = nb
+	c.sendMu.Unlock()
+
+	select {
+	case c.sendAckCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// waitSendWindow blocks until n bytes can be retained. If abort is set, waiting
+// stops with os.ErrDeadlineExceeded once the current Write is aborted.
+func (c *Conn) waitSendWindow(n int, abort <-chan struct{}) error {
+	for {
+		c.sendMu.Lock()
+		free := c.sendWindow - c.sendUnacked.Len()
+		c.sendMu.Unlock()
+
+		if free >= n {
+			return nil
+		}
+
+		select {
+		case <-c.sendAckCh:
+		case <-abort:
+			if c.isSendAborted() {
+				return os.ErrDeadlineExceeded
+			}
+		case <-c.readDone:
+			return c.Err()
+		case <-c.ctx.Done():
+			return c.Err()
+		}
+	}
+}
+
+// waitSendAcked blocks until the relay has acked all retained data.
+func (c *Conn) waitSendAcked() error {
+	for {
+		c.sendMu.Lock()
+		unacked := c.sendUnacked.Len()
+		c.sendMu.Unlock()
+
+		if unacked == 0 {
+			return nil
+		}
+
+		select {
+		case <-c.sendAckCh:
+		case <-c.readDone:
+			return c.Err()
+		case <-c.ctx.Done():
+			return c.Err()
+		}
+	}
+}
+
+// writeRetained writes a data frame, keeping a copy until the relay acks it
+// so it can be resent after a reconnect.
+func (c *Conn) writeRetained(buf []byte) error {
+	if err := c.waitSendWindow(len(buf), nil); err != nil {
+		return err
+	}
+
+	// hold the lock so the data can't be both resent by a reconnect and
+	// written to the new connection
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+
+	c.sendMu.Lock()
+	c.sendUnacked.Write(buf)
+	c.sendMu.Unlock()
+
+	// a failed write is resent once the read loop has reconnected, but the read
+	// loop might not notice the connection broke, so close it to make sure
+	if err := c.writeDataFrames(c.conn, buf); err != nil {
+		if !c.Connected() || c.ctx.Err() != nil || !isTransient(err) {
+			return err
+		}
+		c.conn.Close()
+	}
+	return nil
+}
+
+// SetSendWindow sets how many bytes can be sent without being acked by the relay
+// before Write blocks. Unacked data is retained for resending after a reconnect, so
+// the window is the most memory that takes up. It only applies with WithReconnect,
+// must be more than the relay acks at once and can be at most 64 MiB. Growing the
+// window wakes a blocked Write.
+func (c *Conn) SetSendWindow(bytes uint64) error {
+	if c.sendUnacked == nil {
+		return &ConfigError{"send window requires WithReconnect"}
+	}
+	// the relay only acks once enough data has arrived, so anything smaller
+	// could stall forever
+	if bytes < minSendWindow || bytes > maxSendWindow {
+		return &ConfigError{fmt.Sprintf("send window must be between %d and %d bytes", minSendWindow, maxSendWindow)}
+	}
+
+	c.sendMu.Lock()
+	c.sendUnacked.Grow(int(bytes))
+	c.sendWindow = int(bytes)
+	c.sendMu.Unlock()
+
+	select {
+	case c.sendAckCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SendWindow returns the send window, or 0 without WithReconnect.
+func (c *Conn) SendWindow() uint64 {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return uint64(c.sendWindow)
+}
+
+// SendWindowRemaining returns how many more bytes can be sent before Write blocks
+// waiting for the relay to ack, or 0 without WithReconnect.
+func (c *Conn) SendWindowRemaining() uint64 {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if c.sendUnacked == nil {
+		return 0
+	}
+	return uint64(max(c.sendWindow-c.sendUnacked.Len(), 0))
+}
+
+// SendReady reports whether data can be sent without waiting for the relay to ack.
+// It is always true without WithReconnect, as there is no send window.
+func (c *Conn) SendReady() bool {
+	return c.sendUnacked == nil || c.SendWindowRemaining() > 0
+}
+
+// Checkpoint is the state of a session needed to resume it with
+// WithResumeCheckpoint.
+type Checkpoint struct {
+	SessionID string
+	// SendAcked is the number of bytes sent and acked by the relay.
+	SendAcked uint64
+	// RecvAcked is the number of bytes received and acked to the relay, which
+	// resends anything after it when the session is resumed.
+	RecvAcked uint64
+}
+
+// Checkpoint returns the state needed to resume the session with
+// WithResumeCheckpoint, for example after the process restarts. Data received is
+// acked before Read returns it, so only save a checkpoint once everything read has
+// been dealt with, or it won't be received again.
+func (c *Conn) Checkpoint() Checkpoint {
+	return Checkpoint{c.SessionID(), c.Sent(), c.Received()}
+}
+
+// resumeFrom sets up a new Conn as already connected to the session of checkpoint.
+func (c *Conn) resumeFrom(checkpoint *Checkpoint) {
+	c.sessionID = []byte(checkpoint.SessionID)
+	c.sendNbAcked = checkpoint.SendAcked
+	c.recvNbAcked = checkpoint.RecvAcked
+	c.recvNbUnacked = checkpoint.RecvAcked
+	c.connected = true
+	close(c.connectedCh)
+}
+
+// dialResume dials the relay to resume the session of a checkpoint and waits for it
+// to ack the reconnect, so a session the relay no longer has fails the dial.
+func dialResume(ctx context.Context, connectURL string, dopts *dialOptions, opts []DialOption) (*Conn, error) {
+	url, err := reconnectURL(connectURL, dopts, dopts.Resume.SessionID, dopts.Resume.RecvAcked)
+	if err != nil {
+		return nil, err
+	}
+
+	netConn, resp, err := dialWebsocket(ctx, url, dopts)
+	if err != nil {
+		return nil, err
+	}
+
+	frame, err := decodeFrame(netConn, 0)
+	if err == nil && frame.Tag != subprotoTagReconnectAck {
+		err = &ProtocolError{Err: "expected reconnect ack frame but did not receive one"}
+	}
+	if err != nil {
+		netConn.Close()
+		return nil, resumeError(err)
+	}
+
+	// reconnects go to the connect URL like any other Conn
+	c := NewConn(netConn, append(opts[:len(opts):len(opts)], withURL(connectURL), withHandshakeResponse(resp))...)
+	if err := c.ackSent(binary.BigEndian.Uint64(frame.Payload), true); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// resumeError wraps err in ErrSessionExpired if the relay ended the connection
+// rather than it breaking, which is how the relay refuses to resume a session.
+func resumeError(err error) error {
+	if isTransient(err) {
+		return err
+	}
+
+	var closeError websocket.CloseError
+	if errors.As(err, &closeError) {
+		err = &CloseError{int(closeError.Code), closeError.Reason}
+	}
+	return fmt.Errorf("%w: %w", ErrSessionExpired, err)
+}
+
+func (c *Conn) shouldReconnect(err error) bool {
+	// a Conn made with NewConn has nothing to redial
+	if c.sendUnacked == nil || !c.connected || c.url == "" || c.ctx.Err() != nil {
+		return false
+	}
+
+	return isTransient(err)
+}
+
+// isTransient reports whether err broke the connection to the relay without the
+// relay ending the session, so it can be resumed by reconnecting.
+func isTransient(err error) bool {
+	// the relay closed the connection on purpose
+	if err == io.EOF {
+		return false
+	}
+
+	var closeError websocket.CloseError
+	var protocolError *ProtocolError
+
+	return !errors.As(err, &closeError) && !errors.As(err, &protocolError)
+}
+
+func (c *Conn) reconnect() error {
+	c.conn.Close()
+
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	var err error
+
+	for attempt := 1; attempt <= maxReconnectAttempts; attempt++ {
+		err = c.redial()
+		fields := map[string]any{"attempt": attempt}
+		if err != nil {
+			fields["err"] = err.Error()
+		}
+		c.dopts.Transcript.event("reconnect", fields)
+		if c.dopts.ReconnectCallback != nil {
+			c.dopts.ReconnectCallback(attempt, err)
+		}
+		if err == nil {
+			c.reconnects.Add(1)
+			break
+		}
+		if attempt == maxReconnectAttempts {
+			break
+		}
+
+		timer := c.clock.NewTimer(time.Duration(attempt) * reconnectBackoff)
+		select {
+		case <-timer.C():
+		case <-c.ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+
+	return err
+}
+
+func (c *Conn) redial() error {
+	c.ackMu.Lock()
+	received := c.recvNbUnacked
+	c.ackMu.Unlock()
+
+	url, err := reconnectURL(c.url, c.dopts, c.SessionID(), received)
+	if err != nil {
+		return err
+	}
+
+	// a token is fetched for every dial, so reconnecting after the relay dropped
+	// the connection because the token expired uses a fresh one
+	netConn, resp, err := dialWebsocket(c.ctx, url, c.dopts)
+	if err != nil {
+		return err
+	}
+	netConn = c.wrapConn(netConn)
+
+	if err := c.resume(netConn); err != nil {
+		netConn.Close()
+		return err
+	}
+
+	c.conn = netConn
+	c.handshakeResp = resp
+
+	c.ackMu.Lock()
+	c.recvNbAcked = received
+	c.ackMu.Unlock()
+
+	return nil
+}
+
+// resume waits for the relay to ack the reconnect and resends any data it didn't receive.
+func (c *Conn) resume(netConn net.Conn) error {
+	bytes := [2]byte{}
+	if _, err := io.ReadFull(netConn, bytes[:]); err != nil {
+		return err
+	}
+
+	if binary.BigEndian.Uint16(bytes[:]) != subprotoTagReconnectAck {
+		return &ProtocolError{Err: "expected reconnect ack frame but did not receive one"}
+	}
+	if err := c.readReconnectAckFrame(netConn); err != nil {
+		return err
+	}
+
+	c.sendMu.Lock()
+	head, tail := c.sendUnacked.Bytes()
+	c.sendMu.Unlock()
+
+	// resend in batches like writeBatch, so no message is larger than a batch
+	for _, buf := range [][]byte{head, tail} {
+		for len(buf) > 0 {
+			n := min(len(buf), subprotoMaxBatchFrames*subprotoMaxFrameSize)
+			if err := c.writeDataFrames(netConn, buf[:n]); err != nil {
+				return err
+			}
+			c.bytesReplayed.Add(uint64(n))
+			buf = buf[n:]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package iap
+
+// ringBuffer is a fixed capacity FIFO byte buffer.
+type ringBuffer struct {
+	buf   []byte
+	start int
+	len   int
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{buf: make([]byte, size)}
+}
+
+// Len returns the number of buffered bytes.
+func (r *ringBuffer) Len() int {
+	return r.len
+}
+
+// Cap returns the capacity of the buffer.
+func (r *ringBuffer) Cap() int {
+	return len(r.buf)
+}
+
+// Grow increases the capacity of the buffer to size, keeping the buffered bytes.
+// Slices previously returned by Bytes keep referring to the old storage.
+func (r *ringBuffer) Grow(size int) {
+	if size <= len(r.buf) {
+		return
+	}
+
+	buf := make([]byte, size)
+	head, tail := r.Bytes()
+	copy(buf[copy(buf, head):], tail)
+
+	r.buf = buf
+	r.start = 0
+}
+
+// Free returns the number of bytes that can be written before the buffer is full.
+func (r *ringBuffer) Free() int {
+	return len(r.buf) - r.len
+}
+
+// Write appends p to the buffer. It panics if p does not fit.
+func (r *ringBuffer) Write(p []byte) {
+	if len(p) > r.Free() {
+		panic("ring buffer overflow")
+	}
+
+	end := (r.start + r.len) % len(r.buf)
+	n := copy(r.buf[end:], p)
+	copy(r.buf, p[n:])
+	r.len += len(p)
+}
+
+// Discard drops the first n bytes from the buffer.
+func (r *ringBuffer) Discard(n int) {
+	n = min(n, r.len)
+	r.start = (r.start + n) % len(r.buf)
+	r.len -= n
+}
+
+// Bytes returns the buffered bytes in order as up to two slices aliasing the buffer.
+func (r *ringBuffer) Bytes() ([]byte, []byte) {
+	end := r.start + r.len
+	if end <= len(r.buf) {
+		return r.buf[r.start:end], nil
+	}
+	return r.buf[r.start:], r.buf[:end-len(r.buf)]
+}
+
+// Read copies buffered bytes into p and drops them from the buffer.
+func (r *ringBuffer) Read(p []byte) int {
+	head, tail := r.Bytes()
+	n := copy(p, head)
+	n += copy(p[n:], tail)
+	r.Discard(n)
+	return n
+}
+
+// Available returns the contiguous free space after the buffered bytes, which can
+// be filled directly and then added with Commit.
+func (r *ringBuffer) Available() []byte {
+	if r.len == len(r.buf) {
+		return nil
+	}
+
+	end := (r.start + r.len) % len(r.buf)
+	if end < r.start {
+		return r.buf[end:r.start]
+	}
+	return r.buf[end:]
+}
+
+// Commit adds n bytes written into the slice returned by Available.
+func (r *ringBuffer) Commit(n int) {
+	r.len += n
+}
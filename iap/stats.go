@@ -0,0 +1,178 @@
+package iap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultRateWindow = 5 * time.Second
+
+// Stats is a snapshot of a connection's counters.
+type Stats struct {
+	// Sent is the number of bytes sent and acked.
+	Sent uint64
+	// Received is the number of bytes received and acked.
+	Received uint64
+	// SendRate is the recent send rate in bytes per second.
+	SendRate float64
+	// RecvRate is the recent receive rate in bytes per second.
+	RecvRate float64
+	// Reconnects is the number of times the connection was reestablished
+	// after dropping with WithReconnect.
+	Reconnects uint64
+	// BytesReplayed is the number of bytes resent after reconnecting because
+	// the relay hadn't acked them.
+	BytesReplayed uint64
+	// RecvBacklog is the number of received bytes buffered waiting to be read.
+	// It stays 0 without WithRecvBufferCapacity.
+	RecvBacklog int
+	// RecvBacklogCap is the capacity set with WithRecvBufferCapacity, or 0.
+	RecvBacklogCap int
+	// Backend identifies the backend serving the tunnel, see Conn.Backend.
+	Backend string
+	// CloseReason is why the connection ended, or CloseReasonNone while it's open.
+	CloseReason CloseReason
+	// CloseDetail describes the close further for some reasons, such as the code
+	// and reason sent by the relay.
+	CloseDetail string
+}
+
+// CloseReason categorizes why a connection ended.
+type CloseReason int
+
+const (
+	// CloseReasonNone means the connection is still open.
+	CloseReasonNone CloseReason = iota
+	// CloseReasonLocal means Close or CloseGracefully was called.
+	CloseReasonLocal
+	// CloseReasonEOF means the relay closed the connection normally.
+	CloseReasonEOF
+	// CloseReasonRelay means the relay closed the connection with an error code.
+	CloseReasonRelay
+	// CloseReasonProtocol means the relay broke the protocol, see ProtocolError.
+	CloseReasonProtocol
+	// CloseReasonIdleTimeout means the connection was closed by WithIdleTimeout.
+	CloseReasonIdleTimeout
+	// CloseReasonLifetime means the context set with WithLifetimeContext is done.
+	CloseReasonLifetime
+	// CloseReasonError means any other error, such as a network failure.
+	CloseReasonError
+	// CloseReasonKeepAlive means the connection was closed by WithKeepAlive.
+	CloseReasonKeepAlive
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case CloseReasonNone:
+		return "none"
+	case CloseReasonLocal:
+		return "local"
+	case CloseReasonEOF:
+		return "eof"
+	case CloseReasonRelay:
+		return "relay"
+	case CloseReasonProtocol:
+		return "protocol"
+	case CloseReasonIdleTimeout:
+		return "idle timeout"
+	case CloseReasonLifetime:
+		return "lifetime"
+	case CloseReasonError:
+		return "error"
+	case CloseReasonKeepAlive:
+		return "keepalive"
+	}
+	return fmt.Sprintf("CloseReason(%d)", int(r))
+}
+
+// closeReason categorizes the error that ended a connection. Only the first error
+// is kept, so it's the one that started the teardown.
+func closeReason(err error) (CloseReason, string) {
+	var closeError *CloseError
+	var protocolError *ProtocolError
+
+	switch {
+	case err == nil:
+		return CloseReasonNone, ""
+	case errors.Is(err, net.ErrClosed):
+		return CloseReasonLocal, ""
+	case err == io.EOF:
+		return CloseReasonEOF, ""
+	case errors.As(err, &closeError):
+		return CloseReasonRelay, fmt.Sprintf("code %v (%v)", closeError.Code, closeError.Reason)
+	case errors.As(err, &protocolError):
+		return CloseReasonProtocol, protocolError.Err
+	case errors.Is(err, ErrIdleTimeout):
+		return CloseReasonIdleTimeout, ""
+	case errors.Is(err, ErrKeepAliveTimeout):
+		return CloseReasonKeepAlive, ""
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		// only the lifetime context closes a connection with its error
+		return CloseReasonLifetime, err.Error()
+	}
+	return CloseReasonError, err.Error()
+}
+
+// rateMeter tracks an exponentially weighted moving average of a byte rate.
+// Each byte contributes 1/window to the rate, decaying with time constant window,
+// so a steady rate converges to its true value after a few windows.
+type rateMeter struct {
+	mu     sync.Mutex
+	window time.Duration
+	value  float64
+	last   time.Time
+}
+
+// decay ages the rate to now. mu must be held.
+func (m *rateMeter) decay(now time.Time) {
+	if !m.last.IsZero() {
+		m.value *= math.Exp(-float64(now.Sub(m.last)) / float64(m.window))
+	}
+	m.last = now
+}
+
+func (m *rateMeter) add(n int, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.decay(now)
+	m.value += float64(n) / m.window.Seconds()
+}
+
+func (m *rateMeter) rate(now time.Time) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.decay(now)
+	return m.value
+}
+
+// Stats returns a snapshot of the connection's counters and rates.
+func (c *Conn) Stats() Stats {
+	now := c.clock.Now()
+	backlog, backlogCap := c.recvPipe.backlogLen()
+	reason, detail := closeReason(c.Err())
+
+	return Stats{
+		Sent:     c.Sent(),
+		Received: c.Received(),
+		SendRate: c.sendRate.rate(now),
+		RecvRate: c.recvRate.rate(now),
+
+		Reconnects:    c.reconnects.Load(),
+		BytesReplayed: c.bytesReplayed.Load(),
+
+		RecvBacklog:    backlog,
+		RecvBacklogCap: backlogCap,
+
+		Backend:     c.Backend(),
+		CloseReason: reason,
+		CloseDetail: detail,
+	}
+}
@@ -0,0 +1,101 @@
+package iap
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// defaultInterface is the network interface ParseTarget tunnels to.
+const defaultInterface = "nic0"
+
+// ParseTarget returns the options for tunneling to the instance described by a
+// gcloud-style target, either a resource path like
+// projects/my-project/zones/us-central1-a/instances/my-instance or the shorthand
+// my-project/us-central1-a/my-instance. Either form can end with :port, which
+// otherwise has to be set with WithPort. The tunnel goes to the nic0 interface.
+func ParseTarget(target string) ([]DialOption, error) {
+	path, port := target, ""
+	// the project can contain a colon too, so only look after the last slash
+	if i := strings.LastIndex(target, ":"); i > strings.LastIndex(target, "/") {
+		path, port = target[:i], target[i+1:]
+	}
+
+	var project, zone, instance string
+
+	switch parts := strings.Split(path, "/"); {
+	case len(parts) == 6 && parts[0] == "projects" && parts[2] == "zones" && parts[4] == "instances":
+		project, zone, instance = parts[1], parts[3], parts[5]
+	case len(parts) == 3:
+		project, zone, instance = parts[0], parts[1], parts[2]
+	default:
+		return nil, &ConfigError{fmt.Sprintf("target %q must be projects/PROJECT/zones/ZONE/instances/INSTANCE or PROJECT/ZONE/INSTANCE", target)}
+	}
+
+	if err := checkProject(project); err != nil {
+		return nil, &ConfigError{fmt.Sprintf("target %q has an invalid project: %v", target, err)}
+	}
+	if zone == "" || instance == "" {
+		return nil, &ConfigError{fmt.Sprintf("target %q is missing a zone or instance", target)}
+	}
+
+	opts := []DialOption{
+		WithProject(project),
+		WithInstance(instance, zone, defaultInterface),
+	}
+
+	if port != "" {
+		if !isValidPort(port) {
+			return nil, &ConfigError{fmt.Sprintf("target %q has an invalid port", target)}
+		}
+		opts = append(opts, WithPort(port))
+	}
+
+	return opts, nil
+}
+
+// ParseHost splits the address of a destination for WithHost into a host and a port,
+// which is empty if addr doesn't have one. The host is a hostname or IP address, and
+// an IPv6 address followed by a port must be in brackets, as in [2001:db8::1]:22.
+// An IPv6 address without brackets is never split, since where a port would start
+// is ambiguous.
+func ParseHost(addr string) (host, port string, err error) {
+	switch {
+	case strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]"):
+		host = addr[1 : len(addr)-1]
+		if net.ParseIP(host) == nil {
+			return "", "", &ConfigError{fmt.Sprintf("address %q has brackets around something other than an IP address", addr)}
+		}
+		return host, "", nil
+	case !strings.Contains(addr, ":") || net.ParseIP(addr) != nil:
+		host = addr
+	default:
+		host, port, err = net.SplitHostPort(addr)
+		if err != nil {
+			return "", "", &ConfigError{fmt.Sprintf("address %q must be a host or host:port: %v", addr, err)}
+		}
+		if !isValidPort(port) {
+			return "", "", &ConfigError{fmt.Sprintf("address %q has an invalid port", addr)}
+		}
+	}
+
+	if host == "" {
+		return "", "", &ConfigError{fmt.Sprintf("address %q is missing a host", addr)}
+	}
+	return host, port, nil
+}
+
+// isValidPort reports whether port is a TCP port number other than 0.
+func isValidPort(port string) bool {
+	n, err := strconv.ParseUint(port, 10, 16)
+	return err == nil && n != 0
+}
+
+// Destination returns the zone, instance, host and port that opts tunnel to. Later
+// options override earlier ones as they do when dialing.
+func Destination(opts ...DialOption) (zone, instance, host, port string) {
+	dopts := &dialOptions{}
+	dopts.collectOpts(opts)
+	return dopts.Zone, dopts.Instance, dopts.Host, dopts.Port
+}
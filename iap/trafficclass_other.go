@@ -0,0 +1,11 @@
+//go:build !unix
+
+package iap
+
+import "syscall"
+
+// setSockTrafficClass does nothing as setting the traffic class isn't supported on
+// this platform.
+func setSockTrafficClass(network string, c syscall.RawConn, tos int) error {
+	return nil
+}
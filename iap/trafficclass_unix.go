@@ -0,0 +1,21 @@
+//go:build unix
+
+package iap
+
+import "syscall"
+
+// setSockTrafficClass sets IP_TOS, or IPV6_TCLASS for IPv6, on the socket of c.
+func setSockTrafficClass(network string, c syscall.RawConn, tos int) error {
+	level, opt := syscall.IPPROTO_IP, syscall.IP_TOS
+	if network == "tcp6" {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+	}
+
+	var err error
+	if ctrlErr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), level, opt, tos)
+	}); ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
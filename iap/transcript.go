@@ -0,0 +1,258 @@
+package iap
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transcript writes the events of a connection set by WithTranscript as JSON lines,
+// along with counts of the frames exchanged with the relay. Its methods do nothing
+// on a nil transcript.
+type transcript struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	start  time.Time
+	frames map[Direction]map[string]uint64
+}
+
+func newTranscript(w io.Writer) *transcript {
+	return &transcript{
+		enc:   json.NewEncoder(w),
+		start: time.Now(),
+		frames: map[Direction]map[string]uint64{
+			DirectionSent:     {},
+			DirectionReceived: {},
+		},
+	}
+}
+
+// event writes a line with the name of the event and fields, which it owns.
+func (t *transcript) event(name string, fields map[string]any) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	fields["event"] = name
+	fields["time"] = now.UTC().Format(time.RFC3339Nano)
+	fields["elapsed"] = now.Sub(t.start).String()
+
+	// like frame capture, writing is best effort and mustn't break the connection
+	t.enc.Encode(fields)
+}
+
+// dial records a WebSocket handshake with the relay, leaving out the access token
+// and the session ID of a reconnect, which would let anyone reading the transcript
+// take over the session. The ack of a reconnect is recorded in its own field.
+func (t *transcript) dial(rawURL string, header http.Header, resp *http.Response, err error) {
+	if t == nil {
+		return
+	}
+
+	header = header.Clone()
+	if auth := header.Get("Authorization"); auth != "" {
+		tokenType, _, _ := strings.Cut(auth, " ")
+		header.Set("Authorization", tokenType+" REDACTED")
+	}
+
+	fields := map[string]any{"url": rawURL, "header": header}
+	if u, err := url.Parse(rawURL); err != nil {
+		// don't risk recording a session ID that couldn't be found
+		fields["url"] = "REDACTED"
+	} else if query := u.Query(); query.Has("sid") {
+		query.Set("sid", "REDACTED")
+		if ack, err := strconv.ParseUint(query.Get("ack"), 10, 64); err == nil {
+			fields["ack"] = ack
+			query.Del("ack")
+		}
+		u.RawQuery = query.Encode()
+		fields["url"] = u.String()
+	}
+	if resp != nil {
+		fields["status"] = resp.StatusCode
+		fields["extensions"] = resp.Header.Get("Sec-WebSocket-Extensions")
+	}
+	if err != nil {
+		fields["err"] = err.Error()
+	}
+	t.event("dial", fields)
+}
+
+// open records the options a Conn was made with.
+func (t *transcript) open(dopts *dialOptions) {
+	if t == nil {
+		return
+	}
+
+	t.event("open", map[string]any{
+		"url":            dopts.URL,
+		"correlation_id": dopts.CorrelationID,
+		"options": map[string]any{
+			"protocol_version":     dopts.protocolVersion(),
+			"compression":          compressionName(dopts.CompressionMode),
+			"reconnect":            dopts.Reconnect,
+			"resume":               dopts.Resume != nil,
+			"idle_timeout":         dopts.IdleTimeout.String(),
+			"keepalive":            dopts.KeepAlive.String(),
+			"read_limit":           dopts.readLimit(),
+			"max_recv_frame_size":  dopts.MaxRecvFrameSize,
+			"read_buffer_size":     dopts.ReadBufferSize,
+			"recv_buffer_capacity": dopts.RecvBufferCap,
+			"write_buffer_size":    dopts.WriteBufferSize,
+			"coalesce_delay":       dopts.CoalesceDelay.String(),
+			"rate_limit":           dopts.RateLimit,
+			"manual_ack":           dopts.ManualAck,
+			"ack_delay":            dopts.AckDelay.String(),
+		},
+	})
+}
+
+// close records why a Conn ended, with its final stats and frame counts.
+func (t *transcript) close(stats Stats) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	frames := map[string]map[string]uint64{"sent": {}, "received": {}}
+	for tag, n := range t.frames[DirectionSent] {
+		frames["sent"][tag] = n
+	}
+	for tag, n := range t.frames[DirectionReceived] {
+		frames["received"][tag] = n
+	}
+	t.mu.Unlock()
+
+	t.event("close", map[string]any{
+		"reason":         stats.CloseReason.String(),
+		"detail":         stats.CloseDetail,
+		"sent":           stats.Sent,
+		"received":       stats.Received,
+		"reconnects":     stats.Reconnects,
+		"bytes_replayed": stats.BytesReplayed,
+		"frames":         frames,
+	})
+}
+
+// countFrames feeds bytes sent or received in dir to counter, counting the frames
+// they start.
+func (t *transcript) countFrames(dir Direction, counter *frameCounter, buf []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	counter.count(buf, func(tag uint16) {
+		t.frames[dir][frameTagName(tag)]++
+	})
+}
+
+func frameTagName(tag uint16) string {
+	switch tag {
+	case subprotoTagSuccess:
+		return "success"
+	case subprotoTagReconnectAck:
+		return "reconnect_ack"
+	case subprotoTagData:
+		return "data"
+	case subprotoTagAck:
+		return "ack"
+	}
+	return "unknown"
+}
+
+func compressionName(mode CompressionMode) string {
+	switch mode {
+	case CompressionContextTakeover:
+		return "context takeover"
+	case CompressionNoContextTakeover:
+		return "no context takeover"
+	}
+	return "disabled"
+}
+
+// frameCounter finds the frames in a stream of bytes split at any point, without
+// buffering more than a frame header.
+type frameCounter struct {
+	header [dataFrameHeaderSize]byte
+	n      int
+	skip   int
+	broken bool
+}
+
+// count consumes buf and calls fn with the tag of every frame whose header ends in it.
+func (f *frameCounter) count(buf []byte, fn func(tag uint16)) {
+	for len(buf) > 0 && !f.broken {
+		if f.skip > 0 {
+			n := min(f.skip, len(buf))
+			f.skip -= n
+			buf = buf[n:]
+			continue
+		}
+
+		n := copy(f.header[f.n:f.headerLen()], buf)
+		f.n += n
+		buf = buf[n:]
+		if f.n < f.headerLen() {
+			continue
+		}
+
+		tag := binary.BigEndian.Uint16(f.header[:2])
+		switch tag {
+		case subprotoTagSuccess, subprotoTagData:
+			f.skip = int(binary.BigEndian.Uint32(f.header[2:]))
+		case subprotoTagReconnectAck, subprotoTagAck:
+			f.skip = 8
+		default:
+			// the length of an unknown frame isn't known, so nothing after it is
+			f.broken = true
+		}
+		f.n = 0
+		fn(tag)
+	}
+}
+
+// headerLen returns the size of the header of the frame being read, which depends
+// on its tag once that's known.
+func (f *frameCounter) headerLen() int {
+	if f.n < 2 {
+		return 2
+	}
+	switch binary.BigEndian.Uint16(f.header[:2]) {
+	case subprotoTagSuccess, subprotoTagData:
+		return dataFrameHeaderSize
+	}
+	return 2
+}
+
+// transcriptConn counts the frames read from and written to the relay in a transcript.
+type transcriptConn struct {
+	net.Conn
+	transcript *transcript
+	recv, sent frameCounter
+}
+
+func (c *transcriptConn) Read(buf []byte) (int, error) {
+	n, err := c.Conn.Read(buf)
+	if n > 0 {
+		c.transcript.countFrames(DirectionReceived, &c.recv, buf[:n])
+	}
+	return n, err
+}
+
+func (c *transcriptConn) Write(buf []byte) (int, error) {
+	n, err := c.Conn.Write(buf)
+	if n > 0 {
+		c.transcript.countFrames(DirectionSent, &c.sent, buf[:n])
+	}
+	return n, err
+}
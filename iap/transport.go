@@ -0,0 +1,103 @@
+package iap
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// httpClient returns the HTTP client for the WebSocket handshake, or nil to use
+// the default client.
+func httpClient(dopts *dialOptions) *http.Client {
+	if dopts.HTTPClient != nil {
+		return dopts.HTTPClient
+	}
+	if dopts.RelayAddr == "" && dopts.TLSConfig == nil && dopts.HTTPProxy == nil && dopts.TCPNoDelay == nil && dopts.TrafficClass == nil {
+		return nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if dopts.HTTPProxy != nil {
+		transport.Proxy = http.ProxyURL(dopts.HTTPProxy)
+	}
+
+	if dopts.TLSConfig != nil {
+		transport.TLSClientConfig = dopts.TLSConfig.Clone()
+	}
+
+	if dopts.RelayAddr != "" {
+		// connecting to a pinned address through a proxy makes no sense
+		transport.Proxy = nil
+	}
+
+	if dopts.RelayAddr != "" || dopts.TCPNoDelay != nil || dopts.TrafficClass != nil {
+		dialer := &net.Dialer{}
+		if dopts.TrafficClass != nil {
+			dialer.Control = func(network, address string, c syscall.RawConn) error {
+				return setTrafficClass(network, c, *dopts.TrafficClass)
+			}
+		}
+		transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			if dopts.RelayAddr != "" {
+				address = pinnedAddress(dopts.RelayAddr, address)
+			}
+
+			conn, err := dialer.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+
+			if tcpConn, ok := conn.(*net.TCPConn); ok && dopts.TCPNoDelay != nil {
+				if err := setNoDelay(tcpConn, *dopts.TCPNoDelay); err != nil {
+					conn.Close()
+					return nil, err
+				}
+			}
+			return conn, nil
+		}
+	}
+
+	return &http.Client{Transport: transport}
+}
+
+// setNoDelay sets TCP_NODELAY on a connection to the relay. It's a variable so
+// tests can observe it.
+var setNoDelay = (*net.TCPConn).SetNoDelay
+
+// setTrafficClass sets the traffic class of a socket to the relay before it
+// connects. It's a variable so tests can observe it.
+var setTrafficClass = setSockTrafficClass
+
+// sameTransport reports whether o reaches the relay the same way as d, so they can
+// share an HTTP client.
+func (d *dialOptions) sameTransport(o *dialOptions) bool {
+	if (d.TCPNoDelay == nil) != (o.TCPNoDelay == nil) {
+		return false
+	}
+	if d.TCPNoDelay != nil && *d.TCPNoDelay != *o.TCPNoDelay {
+		return false
+	}
+	if (d.TrafficClass == nil) != (o.TrafficClass == nil) {
+		return false
+	}
+	if d.TrafficClass != nil && *d.TrafficClass != *o.TrafficClass {
+		return false
+	}
+	return d.RelayAddr == o.RelayAddr && d.TLSConfig == o.TLSConfig && d.HTTPProxy == o.HTTPProxy
+}
+
+// pinnedAddress returns the address to dial instead of address, taking the port
+// from address if relayAddr doesn't have one.
+func pinnedAddress(relayAddr, address string) string {
+	if _, _, err := net.SplitHostPort(relayAddr); err == nil {
+		return relayAddr
+	}
+
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return relayAddr
+	}
+	return net.JoinHostPort(relayAddr, port)
+}
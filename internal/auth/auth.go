@@ -0,0 +1,37 @@
+// Package auth gets the tokens used to authorize tunnels.
+package auth
+
+import (
+	"context"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// TokenSource returns a token source for Application Default Credentials with the
+// given scopes. If serviceAccount is set, the credentials impersonate it instead,
+// which requires them to have roles/iam.serviceAccountTokenCreator on it.
+func TokenSource(ctx context.Context, scopes []string, serviceAccount string) (oauth2.TokenSource, error) {
+	if serviceAccount == "" {
+		return google.DefaultTokenSource(ctx, scopes...)
+	}
+	return impersonatedTokenSource(ctx, scopes, serviceAccount)
+}
+
+// impersonatedTokenSource returns a token source for serviceAccount from the IAM
+// Credentials API, which is called with Application Default Credentials unless opts
+// say otherwise.
+func impersonatedTokenSource(ctx context.Context, scopes []string, serviceAccount string, opts ...option.ClientOption) (oauth2.TokenSource, error) {
+	if len(scopes) == 0 {
+		scopes = []string{cloudPlatformScope}
+	}
+
+	return impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: serviceAccount,
+		Scopes:          scopes,
+	}, opts...)
+}
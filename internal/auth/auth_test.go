@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+)
+
+// redirectTransport sends requests to the host of a test server instead.
+type redirectTransport struct {
+	url *url.URL
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.url.Scheme
+	req.URL.Host = t.url.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestImpersonatedTokenSource(t *testing.T) {
+	type request struct {
+		path          string
+		authorization string
+		scopes        []string
+	}
+	requests := make(chan request, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Scope []string `json:"scope"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		requests <- request{r.URL.Path, r.Header.Get("Authorization"), body.Scope}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"accessToken": "impersonated",
+			"expireTime":  time.Now().Add(time.Hour).Format(time.RFC3339),
+		})
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := option.WithHTTPClient(&http.Client{
+		Transport: &oauth2.Transport{
+			Source: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "source"}),
+			Base:   &redirectTransport{serverURL},
+		},
+	})
+	scopes := []string{"https://www.googleapis.com/auth/userinfo.email"}
+
+	tokenSource, err := impersonatedTokenSource(context.Background(), scopes, "tunnel@project.iam.gserviceaccount.com", client)
+	assert.NoError(t, err)
+
+	token, err := tokenSource.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "impersonated", token.AccessToken)
+
+	assert.Equal(t, request{
+		path:          "/v1/projects/-/serviceAccounts/tunnel@project.iam.gserviceaccount.com:generateAccessToken",
+		authorization: "Bearer source",
+		scopes:        scopes,
+	}, <-requests)
+
+	// the token is reused until it expires
+	_, err = tokenSource.Token()
+	assert.NoError(t, err)
+	assert.Empty(t, requests)
+
+	t.Run("Default scopes", func(t *testing.T) {
+		tokenSource, err := impersonatedTokenSource(context.Background(), nil, "tunnel@project.iam.gserviceaccount.com", client)
+		assert.NoError(t, err)
+
+		_, err = tokenSource.Token()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{cloudPlatformScope}, (<-requests).scopes)
+	})
+
+	t.Run("Refused", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "permission denied", http.StatusForbidden)
+		}))
+		defer server.Close()
+
+		serverURL, _ := url.Parse(server.URL)
+		client := option.WithHTTPClient(&http.Client{Transport: &redirectTransport{serverURL}})
+
+		tokenSource, err := impersonatedTokenSource(context.Background(), scopes, "tunnel@project.iam.gserviceaccount.com", client)
+		assert.NoError(t, err)
+
+		_, err = tokenSource.Token()
+		assert.ErrorContains(t, err, "permission denied")
+	})
+}
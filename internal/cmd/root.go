@@ -1,6 +1,10 @@
 package cmd
 
 import (
+	"strings"
+	"time"
+
+	"github.com/cedws/iapc/internal/proxy"
 	"github.com/charmbracelet/log"
 	"github.com/spf13/cobra"
 )
@@ -12,6 +16,15 @@ var (
 	project     string
 	port        uint
 	tokenScopes []string
+	impersonate string
+	idleTimeout time.Duration
+	warmPool    int
+	dialTimeout time.Duration
+	allowDests  []string
+	allowUIDs   []int
+
+	maxDialFailures     int
+	dialFailureCooldown time.Duration
 )
 
 var rootCmd = &cobra.Command{
@@ -22,20 +35,53 @@ var rootCmd = &cobra.Command{
 		if err != nil {
 			log.Warnf("Could not set log level to %s, use one of: {debug|info|warn|error|fatal}", logLevel)
 		}
-		log.SetLevel(level)
+		proxy.SetLogLevel(level)
 	},
 }
 
 func init() {
 	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "Set log level")
 	rootCmd.PersistentFlags().BoolVarP(&compress, "compress", "c", false, "Enable WebSocket compression")
-	rootCmd.PersistentFlags().StringVarP(&listen, "listen", "l", "127.0.0.1:0", "Listen address and port")
-	rootCmd.PersistentFlags().StringVar(&project, "project", "", "Project ID")
+	rootCmd.PersistentFlags().StringVarP(&listen, "listen", "l", "127.0.0.1:0", "Listen address and port, or unix:PATH for a Unix socket")
+	rootCmd.PersistentFlags().StringVar(&project, "project", "", "Project ID or number")
 	rootCmd.PersistentFlags().UintVarP(&port, "port", "p", 22, "Target port")
 	rootCmd.PersistentFlags().StringSliceVarP(&tokenScopes, "token-scopes", "s", []string{"https://www.googleapis.com/auth/cloud-platform"}, "Token scopes")
+	rootCmd.PersistentFlags().StringVar(&impersonate, "impersonate-service-account", "", "Service account to impersonate")
+	rootCmd.PersistentFlags().DurationVar(&idleTimeout, "idle-timeout", 0, "Close tunnels with no traffic for this long (0 to disable)")
+	rootCmd.PersistentFlags().IntVar(&warmPool, "warm-pool", 0, "Keep this many tunnels dialed ahead of new connections")
+	rootCmd.PersistentFlags().DurationVar(&dialTimeout, "dial-timeout", 0, "Disconnect clients whose tunnel takes longer than this to dial (0 to disable)")
+	rootCmd.PersistentFlags().IntVar(&maxDialFailures, "max-dial-failures", 0, "Reject clients for a cooldown after this many dials in a row fail (0 to disable)")
+	rootCmd.PersistentFlags().DurationVar(&dialFailureCooldown, "dial-failure-cooldown", 10*time.Second, "How long to reject clients for after too many dial failures")
+	rootCmd.PersistentFlags().StringArrayVar(&allowDests, "allow-dest", nil, "Only connect clients to destinations matching this pattern, as ZONE/INSTANCE[:PORT] or HOST[:PORT] with * wildcards (repeatable)")
+	rootCmd.PersistentFlags().IntSliceVar(&allowUIDs, "allow-uid", nil, "Only accept clients running as these UIDs, which needs a Unix socket (Linux only)")
 	rootCmd.MarkFlagRequired("project")
 }
 
+// proxyOptions returns the proxy options set by the persistent flags.
+func proxyOptions() []proxy.Option {
+	opts := []proxy.Option{
+		proxy.WithDialTimeout(dialTimeout),
+		proxy.WithCircuitBreaker(maxDialFailures, dialFailureCooldown),
+	}
+
+	if len(allowDests) > 0 {
+		policy, err := proxy.AllowDestinations(allowDests)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, proxy.WithDestinationPolicy(policy))
+	}
+
+	if len(allowUIDs) > 0 {
+		if !strings.HasPrefix(listen, "unix:") {
+			log.Fatal("--allow-uid needs a Unix socket, listen on one with --listen unix:PATH")
+		}
+		opts = append(opts, proxy.WithClientAuthenticator(proxy.AllowUIDs(allowUIDs)))
+	}
+
+	return opts
+}
+
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal(err)
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/internal/auth"
+	"github.com/cedws/iapc/internal/proxy"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+var sniRoutes []string
+
+var sniCmd = &cobra.Command{
+	Use:  "sni",
+	Long: "Route TLS connections to Compute Engine instances by the server name they ask for, without terminating TLS",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+
+		routes := make(map[string][]iap.DialOption)
+		for _, route := range sniRoutes {
+			serverName, target, ok := strings.Cut(route, "=")
+			if !ok || serverName == "" {
+				log.Fatalf("Route %q must be NAME=TARGET", route)
+			}
+
+			opts, err := iap.ParseTarget(target)
+			if err != nil {
+				log.Fatal(err)
+			}
+			routes[strings.ToLower(serverName)] = opts
+		}
+
+		tokenSource, err := auth.TokenSource(ctx, tokenScopes, impersonate)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// targets without a port use --port
+		opts := []iap.DialOption{
+			iap.WithProject(project),
+			iap.WithPort(fmt.Sprint(port)),
+			iap.WithTokenSource(&tokenSource),
+		}
+		if compress {
+			opts = append(opts, iap.WithCompressionMode(iap.CompressionContextTakeover))
+		}
+		if idleTimeout > 0 {
+			opts = append(opts, iap.WithIdleTimeout(idleTimeout))
+		}
+
+		log.Info("Starting proxy", "routes", len(routes), "project", project)
+
+		route := func(serverName string) ([]iap.DialOption, error) {
+			if opts, ok := routes[strings.ToLower(serverName)]; ok {
+				return opts, nil
+			}
+			return nil, fmt.Errorf("no route for server name %q", serverName)
+		}
+
+		proxy.ListenSNI(ctx, listen, opts, route, proxyOptions()...)
+	},
+}
+
+func init() {
+	sniCmd.Flags().StringArrayVar(&sniRoutes, "route", nil, "Route a server name to an instance, as NAME=PROJECT/ZONE/INSTANCE[:PORT] (repeatable)")
+	sniCmd.MarkFlagRequired("route")
+
+	rootCmd.AddCommand(sniCmd)
+}
@@ -3,12 +3,13 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"net"
 
 	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/internal/auth"
 	"github.com/cedws/iapc/internal/proxy"
 	"github.com/charmbracelet/log"
 	"github.com/spf13/cobra"
-	"golang.org/x/oauth2/google"
 )
 
 var (
@@ -21,28 +22,39 @@ var hostCmd = &cobra.Command{
 	Use:  "to-host",
 	Long: "Create a tunnel to a remote private IP or FQDN (requires BeyondCorp Enterprise)",
 	Args: cobra.ExactArgs(1),
-	PreRun: func(cmd *cobra.Command, args []string) {
-		log.Info("Starting proxy", "dest", fmt.Sprintf("%v:%v", args[0], port), "project", project)
-	},
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx := context.Background()
 
-		tokenSource, err := google.DefaultTokenSource(ctx, tokenScopes...)
+		// a port in the address takes precedence over --port
+		host, hostPort, err := iap.ParseHost(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if hostPort == "" {
+			hostPort = fmt.Sprint(port)
+		}
+
+		log.Info("Starting proxy", "dest", net.JoinHostPort(host, hostPort), "project", project)
+
+		tokenSource, err := auth.TokenSource(ctx, tokenScopes, impersonate)
 		if err != nil {
 			log.Fatal(err)
 		}
 
 		opts := []iap.DialOption{
 			iap.WithProject(project),
-			iap.WithHost(args[0], region, network, destGroup),
-			iap.WithPort(fmt.Sprint(port)),
+			iap.WithHost(host, region, network, destGroup),
+			iap.WithPort(hostPort),
 			iap.WithTokenSource(&tokenSource),
 		}
 		if compress {
-			opts = append(opts, iap.WithCompression())
+			opts = append(opts, iap.WithCompressionMode(iap.CompressionContextTakeover))
+		}
+		if idleTimeout > 0 {
+			opts = append(opts, iap.WithIdleTimeout(idleTimeout))
 		}
 
-		proxy.Listen(ctx, listen, opts)
+		proxy.Listen(ctx, listen, opts, append(proxyOptions(), proxy.WithWarmPool(warmPool))...)
 	},
 }
 
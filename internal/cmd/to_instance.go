@@ -5,10 +5,10 @@ import (
 	"fmt"
 
 	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/internal/auth"
 	"github.com/cedws/iapc/internal/proxy"
 	"github.com/charmbracelet/log"
 	"github.com/spf13/cobra"
-	"golang.org/x/oauth2/google"
 )
 
 var (
@@ -26,7 +26,7 @@ var instanceCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx := context.Background()
 
-		tokenSource, err := google.DefaultTokenSource(ctx, tokenScopes...)
+		tokenSource, err := auth.TokenSource(ctx, tokenScopes, impersonate)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -38,10 +38,13 @@ var instanceCmd = &cobra.Command{
 			iap.WithTokenSource(&tokenSource),
 		}
 		if compress {
-			opts = append(opts, iap.WithCompression())
+			opts = append(opts, iap.WithCompressionMode(iap.CompressionContextTakeover))
+		}
+		if idleTimeout > 0 {
+			opts = append(opts, iap.WithIdleTimeout(idleTimeout))
 		}
 
-		proxy.Listen(ctx, listen, opts)
+		proxy.Listen(ctx, listen, opts, append(proxyOptions(), proxy.WithWarmPool(warmPool))...)
 	},
 }
 
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/charmbracelet/log"
+)
+
+// errBreakerOpen is returned for clients rejected while dials are failing.
+var errBreakerOpen = errors.New("rejected after repeated dial failures")
+
+// breaker stops dialing for a cooldown once enough dials in a row have failed, so an
+// outage doesn't turn every new client into another doomed dial to the relay. Once
+// the cooldown is over dials are let through again, and the first to fail reopens it
+// while the first to succeed resets it.
+type breaker struct {
+	dial      dialFunc
+	threshold int
+	cooldown  time.Duration
+	// now is the time source, replaced in tests
+	now func() time.Time
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func newBreaker(dial dialFunc, threshold int, cooldown time.Duration) *breaker {
+	return &breaker{
+		dial:      dial,
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+func (b *breaker) get(ctx context.Context, opts ...iap.DialOption) (tunnel, error) {
+	b.mu.Lock()
+	open := b.now().Before(b.openUntil)
+	b.mu.Unlock()
+
+	if open {
+		return nil, errBreakerOpen
+	}
+
+	tun, err := b.dial(ctx, opts...)
+	// dials abandoned by the caller say nothing about the relay
+	if ctx.Err() == nil {
+		b.record(err)
+	}
+	return tun, err
+}
+
+// record counts the result of a dial, opening the breaker if too many have failed.
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		if b.failures >= b.threshold {
+			log.Info("Dials are succeeding again, accepting clients")
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if now := b.now(); b.failures >= b.threshold && !now.Before(b.openUntil) {
+		b.openUntil = now.Add(b.cooldown)
+		log.Warn("Too many dial failures, rejecting clients", "failures", b.failures, "cooldown", b.cooldown)
+	}
+}
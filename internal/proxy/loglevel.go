@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"sync"
+
+	"github.com/charmbracelet/log"
+)
+
+var (
+	levelMu sync.Mutex
+	// levelBeforeDebug is the level to go back to when debug logging is toggled off
+	levelBeforeDebug = log.InfoLevel
+)
+
+// SetLogLevel sets the level of the proxy's logs, applying to connections already open.
+func SetLogLevel(level log.Level) {
+	levelMu.Lock()
+	defer levelMu.Unlock()
+
+	log.SetLevel(level)
+}
+
+// ToggleDebug switches the proxy's logs to debug level, or back to the level they
+// were at before if they are already at debug level. It returns the new level.
+func ToggleDebug() log.Level {
+	levelMu.Lock()
+	defer levelMu.Unlock()
+
+	if level := log.GetLevel(); level != log.DebugLevel {
+		levelBeforeDebug = level
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(levelBeforeDebug)
+	}
+
+	return log.GetLevel()
+}
@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+)
+
+// Credentials identify the process on the other end of a Unix socket, for a
+// ClientAuthenticator to check.
+type Credentials struct {
+	PID int
+	UID int
+	GID int
+}
+
+var errNotUnixSocket = errors.New("peer credentials are only available for Unix sockets")
+
+// AllowUIDs returns a ClientAuthenticator that only allows clients connecting over a
+// Unix socket from a process running as one of uids. Clients connecting over TCP
+// are refused, since there's no way to tell who they are.
+func AllowUIDs(uids []int) ClientAuthenticator {
+	return func(conn net.Conn) error {
+		creds, err := PeerCredentials(conn)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(uids, creds.UID) {
+			return fmt.Errorf("UID %v isn't allowed", creds.UID)
+		}
+		return nil
+	}
+}
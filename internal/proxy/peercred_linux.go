@@ -0,0 +1,37 @@
+//go:build linux
+
+package proxy
+
+import (
+	"net"
+	"syscall"
+)
+
+// PeerCredentials returns the credentials of the process on the other end of conn,
+// which must be a Unix socket connection, as the kernel recorded them when it
+// connected.
+func PeerCredentials(conn net.Conn) (Credentials, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return Credentials{}, errNotUnixSocket
+	}
+
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	var ucred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	return Credentials{PID: int(ucred.Pid), UID: int(ucred.Uid), GID: int(ucred.Gid)}, nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// PeerCredentials returns the credentials of the process on the other end of conn.
+// Only Linux is supported, elsewhere it returns errors.ErrUnsupported.
+func PeerCredentials(conn net.Conn) (Credentials, error) {
+	if _, ok := conn.(*net.UnixConn); !ok {
+		return Credentials{}, errNotUnixSocket
+	}
+	return Credentials{}, errors.ErrUnsupported
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/charmbracelet/log"
+)
+
+const poolRetryBackoff = time.Second
+
+// tunnel is the part of *iap.Conn used by the proxy.
+type tunnel interface {
+	net.Conn
+	Err() error
+	Sent() uint64
+	Received() uint64
+	CorrelationID() string
+	Done() <-chan struct{}
+}
+
+type dialFunc func(ctx context.Context, opts ...iap.DialOption) (tunnel, error)
+
+// pool keeps tunnels dialed ahead of demand so clients don't wait for the handshake.
+// Tunnels aren't multiplexed, so each is only used by one client and the pool dials a
+// replacement as soon as one is taken, or as soon as one closes while waiting. Every
+// warm tunnel holds a connection open to the destination. Warm tunnels are dialed
+// before their client connects, so they get a correlation ID of their own rather than
+// the client's.
+type pool struct {
+	dial  dialFunc
+	slots []poolSlot
+}
+
+// poolSlot holds the warm tunnel of one fill goroutine.
+type poolSlot struct {
+	conn chan tunnel
+	// taken wakes the fill goroutine to dial a replacement
+	taken chan struct{}
+}
+
+func newPool(ctx context.Context, size int, dial dialFunc) *pool {
+	p := &pool{
+		dial:  dial,
+		slots: make([]poolSlot, size),
+	}
+
+	for i := range p.slots {
+		p.slots[i] = poolSlot{
+			conn:  make(chan tunnel, 1),
+			taken: make(chan struct{}, 1),
+		}
+		go p.fill(ctx, p.slots[i])
+	}
+
+	return p
+}
+
+// fill repeatedly dials a tunnel into slot and waits for a client to take it,
+// replacing it if it closes first.
+func (p *pool) fill(ctx context.Context, slot poolSlot) {
+	for ctx.Err() == nil {
+		id := newCorrelationID()
+		tun, err := p.dial(ctx, iap.WithCorrelationID(id))
+		if err != nil {
+			log.Debug("Error dialing warm tunnel", "id", id, "err", err)
+
+			timer := time.NewTimer(poolRetryBackoff)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+			}
+			continue
+		}
+
+		slot.conn <- tun
+
+		select {
+		case <-slot.taken:
+		case <-tun.Done():
+			select {
+			case tun := <-slot.conn:
+				log.Debug("Warm tunnel closed while waiting", "id", id, "err", tun.Err())
+				tun.Close()
+			case <-slot.taken:
+				// a client took it first, and get finds it closed
+			}
+		case <-ctx.Done():
+			select {
+			case tun := <-slot.conn:
+				tun.Close()
+			default:
+			}
+		}
+	}
+}
+
+// get returns a warm tunnel, or dials a new one with opts if none are ready.
+func (p *pool) get(ctx context.Context, opts ...iap.DialOption) (tunnel, error) {
+	for _, slot := range p.slots {
+		select {
+		case tun := <-slot.conn:
+			slot.taken <- struct{}{}
+
+			// the relay may have closed it just as it was taken
+			if tun.Err() != nil {
+				tun.Close()
+				continue
+			}
+			return tun, nil
+		default:
+		}
+	}
+	return p.dial(ctx, opts...)
+}
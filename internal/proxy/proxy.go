@@ -2,64 +2,364 @@ package proxy
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/cedws/iapc/iap"
 	"github.com/charmbracelet/log"
 )
 
-// Listen starts a proxy server that listens on the given address and port.
-func Listen(ctx context.Context, listen string, opts []iap.DialOption) {
-	if err := testConn(ctx, opts); err != nil {
+// Option configures the proxy server.
+type Option func(*options)
+
+type options struct {
+	warmPool        int
+	dialTimeout     time.Duration
+	breakerFailures int
+	breakerCooldown time.Duration
+	policy          DestinationPolicy
+	authenticator   ClientAuthenticator
+}
+
+// WithCircuitBreaker rejects clients for cooldown once failures dials in a row have
+// failed, rather than dialing the relay for each of them during an outage. Dials
+// resume after the cooldown, and the breaker resets once one succeeds. Dials of the
+// warm pool count too.
+func WithCircuitBreaker(failures int, cooldown time.Duration) Option {
+	return func(o *options) {
+		o.breakerFailures = failures
+		o.breakerCooldown = cooldown
+	}
+}
+
+// DestinationPolicy decides whether a client may be connected to a destination. A
+// non-nil error refuses the client. The zone and instance are empty for tunnels to
+// a host, and the host is empty for tunnels to an instance.
+type DestinationPolicy func(zone, instance, host, port string) error
+
+// AllowDestinations returns a DestinationPolicy that only allows destinations
+// matching one of patterns. Instances are matched as ZONE/INSTANCE[:PORT] and hosts
+// as HOST[:PORT], with an IPv6 host in brackets if a port follows it. Each part can
+// use the wildcards of path.Match, and a pattern without a port matches any port.
+func AllowDestinations(patterns []string) (DestinationPolicy, error) {
+	type pattern struct{ dest, port string }
+
+	var allowed []pattern
+	for _, p := range patterns {
+		dest, port, err := net.SplitHostPort(p)
+		if err != nil {
+			dest, port = p, "*"
+		}
+		if _, err := path.Match(dest, ""); err != nil {
+			return nil, fmt.Errorf("bad destination pattern %q: %w", p, err)
+		}
+		if _, err := path.Match(port, ""); err != nil {
+			return nil, fmt.Errorf("bad destination pattern %q: %w", p, err)
+		}
+		allowed = append(allowed, pattern{dest, port})
+	}
+
+	return func(zone, instance, host, port string) error {
+		dest := host
+		if instance != "" {
+			dest = zone + "/" + instance
+		}
+
+		for _, p := range allowed {
+			destOK, _ := path.Match(p.dest, dest)
+			portOK, _ := path.Match(p.port, port)
+			if destOK && portOK {
+				return nil
+			}
+		}
+		return fmt.Errorf("%v isn't an allowed destination", net.JoinHostPort(dest, port))
+	}, nil
+}
+
+// WithWarmPool keeps size tunnels dialed ahead of demand, so clients are connected
+// without waiting for the handshake. Each warm tunnel holds an idle connection open
+// to the destination. Tunnels that close while waiting, such as by WithIdleTimeout
+// or the relay, are replaced straight away.
+func WithWarmPool(size int) Option {
+	return func(o *options) {
+		o.warmPool = size
+	}
+}
+
+// WithDialTimeout limits how long a client waits for its tunnel to be dialed before
+// being disconnected. Dials are also abandoned when the proxy's context is done.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.dialTimeout = timeout
+	}
+}
+
+// WithDestinationPolicy checks the destination of every client with policy before
+// its tunnel is dialed or taken from the warm pool. Refused clients are logged and
+// disconnected. All destinations are allowed by default.
+func WithDestinationPolicy(policy DestinationPolicy) Option {
+	return func(o *options) {
+		o.policy = policy
+	}
+}
+
+// ClientAuthenticator decides whether a client that connected to the proxy may use
+// it. A non-nil error refuses the client. It can read from conn, such as to check a
+// shared secret sent before anything else, and the bytes it reads aren't forwarded.
+// A deadline it sets on conn is cleared once it returns.
+type ClientAuthenticator func(conn net.Conn) error
+
+// WithClientAuthenticator checks every client with auth as soon as it connects,
+// before reading anything else from it or dialing its tunnel. Refused clients are
+// logged and disconnected. All clients are allowed by default.
+func WithClientAuthenticator(auth ClientAuthenticator) Option {
+	return func(o *options) {
+		o.authenticator = auth
+	}
+}
+
+// Listen starts a proxy server that listens on the given address and port, or on a
+// Unix socket if listen is unix:PATH.
+func Listen(ctx context.Context, listen string, opts []iap.DialOption, proxyOpts ...Option) {
+	var o options
+	for _, opt := range proxyOpts {
+		opt(&o)
+	}
+
+	if err := iap.Probe(ctx, opts...); err != nil {
 		log.Fatalf("Error testing connection: %v", err)
 	}
 
-	listener, err := net.Listen("tcp", listen)
+	listener, err := listenClients(listen)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	log.Info("Listening", "addr", listener.Addr())
 
+	go toggleDebugOnSignal(ctx)
+
+	dial := newDialFunc(ctx, opts, o)
+
+	serve(listener, o.authenticator, func(conn net.Conn) {
+		handleClient(ctx, dial, conn)
+	})
+}
+
+// listenClients listens for clients on listen, a TCP address or unix:PATH for a Unix
+// socket.
+func listenClients(listen string) (net.Listener, error) {
+	if socket, ok := strings.CutPrefix(listen, "unix:"); ok {
+		return net.Listen("unix", socket)
+	}
+	return net.Listen("tcp", listen)
+}
+
+// serve accepts clients from listener and passes each to handle in its own
+// goroutine once auth, if set, allows it. It returns once listener is closed.
+func serve(listener net.Listener, auth ClientAuthenticator, handle func(conn net.Conn)) {
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		go handleClient(ctx, opts, conn)
+		go func() {
+			if auth != nil {
+				err := auth(conn)
+				conn.SetDeadline(time.Time{})
+
+				if err != nil {
+					log.Warn("Client refused", "client", conn.RemoteAddr(), "err", err)
+					conn.Close()
+					return
+				}
+			}
+
+			handle(conn)
+		}()
 	}
 }
 
-func testConn(ctx context.Context, opts []iap.DialOption) error {
-	tun, err := iap.Dial(ctx, opts...)
-	if tun != nil {
-		defer tun.Close()
+// newDialFunc returns the dialFunc for clients of a proxy dialing with opts.
+func newDialFunc(ctx context.Context, opts []iap.DialOption, o options) dialFunc {
+	dialer := iap.NewDialer(opts...)
+	dial := func(ctx context.Context, opts ...iap.DialOption) (tunnel, error) {
+		tun, err := dialer.Dial(ctx, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return tun, nil
+	}
+	if o.dialTimeout > 0 {
+		dial = withDialTimeout(dial, o.dialTimeout)
+	}
+	if o.breakerFailures > 0 {
+		dial = newBreaker(dial, o.breakerFailures, o.breakerCooldown).get
+	}
+	if o.warmPool > 0 {
+		dial = newPool(ctx, o.warmPool, dial).get
+	}
+	if o.policy != nil {
+		dial = withDestinationPolicy(dial, opts, o.policy)
+	}
+	return dial
+}
+
+// withDialTimeout returns a dialFunc that gives up on dial after timeout or once ctx
+// is done. The context of a dial also bounds the lifetime of its tunnel, so rather
+// than giving it a deadline, a tunnel that arrives too late is closed.
+func withDialTimeout(dial dialFunc, timeout time.Duration) dialFunc {
+	type result struct {
+		tun tunnel
+		err error
+	}
+
+	return func(ctx context.Context, opts ...iap.DialOption) (tunnel, error) {
+		resCh := make(chan result, 1)
+		go func() {
+			tun, err := dial(ctx, opts...)
+			resCh <- result{tun, err}
+		}()
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		var err error
+		select {
+		case res := <-resCh:
+			return res.tun, res.err
+		case <-timer.C:
+			err = fmt.Errorf("dial timed out after %v: %w", timeout, context.DeadlineExceeded)
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		go func() {
+			if res := <-resCh; res.err == nil {
+				res.tun.Close()
+			}
+		}()
+		return nil, err
+	}
+}
+
+// errDenied is returned for clients refused by the destination policy.
+var errDenied = errors.New("destination denied by policy")
+
+// withDestinationPolicy returns a dialFunc that only calls dial if policy allows the
+// destination of opts, which are applied after the proxy's own.
+func withDestinationPolicy(dial dialFunc, proxyOpts []iap.DialOption, policy DestinationPolicy) dialFunc {
+	return func(ctx context.Context, opts ...iap.DialOption) (tunnel, error) {
+		zone, instance, host, port := iap.Destination(append(proxyOpts[:len(proxyOpts):len(proxyOpts)], opts...)...)
+		if err := policy(zone, instance, host, port); err != nil {
+			return nil, fmt.Errorf("%w: %w", errDenied, err)
+		}
+		return dial(ctx, opts...)
 	}
-	return err
 }
 
-func handleClient(ctx context.Context, opts []iap.DialOption, conn net.Conn) {
-	log.Info("Client connected", "client", conn.RemoteAddr())
+func handleClient(ctx context.Context, dial dialFunc, conn net.Conn) {
+	defer conn.Close()
 
-	tun, err := iap.Dial(ctx, opts...)
+	// fields are passed on every call rather than with log.With, which copies the
+	// level, so changes to the level apply to connections already open
+	id := newCorrelationID()
+	fields := []any{"id", id, "client", conn.RemoteAddr()}
+
+	log.Info("Client connected", fields...)
+
+	tun, err := dial(ctx, iap.WithCorrelationID(id))
+	if errors.Is(err, errDenied) {
+		log.Warn("Destination denied", append(fields, "err", err)...)
+		return
+	}
 	if err != nil {
-		log.Errorf("Error dialing IAP: %v", err)
+		log.Error("Error dialing IAP", append(fields, "err", err)...)
 		return
 	}
 	defer tun.Close()
 
-	log.Debug("Dialed IAP", "client", conn.RemoteAddr())
+	// a warm tunnel was dialed with an ID of its own
+	if tunID := tun.CorrelationID(); tunID != id {
+		fields = append(fields, "tunnel", tunID)
+	}
 
-	go func() {
-		if _, err := io.Copy(conn, tun); err != nil {
-			log.Debug(err)
-		}
-	}()
-	if _, err := io.Copy(tun, conn); err != nil {
-		log.Debug(err)
+	log.Debug("Dialed IAP", fields...)
+
+	if err := forward(ctx, conn, tun); err != nil {
+		log.Debug("Forwarding failed", append(fields, "err", err)...)
+	}
+
+	log.Info("Client disconnected", append(fields, "sentbytes", tun.Sent(), "recvbytes", tun.Received())...)
+}
+
+// newCorrelationID returns a random ID for the logs of a client connection.
+func newCorrelationID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Forward dials a tunnel and copies data between it and client until either side
+// finishes or ctx is done. Both are closed when it returns.
+func Forward(ctx context.Context, client net.Conn, opts []iap.DialOption) error {
+	return dialForward(ctx, newDialFunc(ctx, opts, options{}), client)
+}
+
+// dialForward is Forward with the tunnel dialed by dial.
+func dialForward(ctx context.Context, dial dialFunc, client net.Conn) error {
+	defer client.Close()
+
+	tun, err := dial(ctx)
+	if err != nil {
+		return err
 	}
+	defer tun.Close()
 
-	log.Info("Client disconnected", "client", conn.RemoteAddr(), "sentbytes", tun.Sent(), "recvbytes", tun.Received())
+	return forward(ctx, client, tun)
+}
+
+// forward copies data both ways between client and tun. When either direction
+// finishes, both conns are closed so the other direction stops too. That includes
+// a client that only half-closes its side, since an IAP tunnel can't pass on EOF
+// without closing entirely (see iap.Conn.CloseWrite). It returns the error of the
+// direction that finished first, or ctx.Err() if ctx is done.
+func forward(ctx context.Context, client, tun net.Conn) error {
+	closeBoth := func() {
+		client.Close()
+		tun.Close()
+	}
+
+	stop := context.AfterFunc(ctx, closeBoth)
+	defer stop()
+
+	errCh := make(chan error, 2)
+	copy := func(dst, src net.Conn) {
+		n, err := io.Copy(dst, src)
+		closeBoth()
+		log.Debug("Stopped copying", "from", src.RemoteAddr(), "to", dst.RemoteAddr(), "bytes", n, "err", err)
+		errCh <- err
+	}
+
+	go copy(tun, client)
+	go copy(client, tun)
+
+	err := <-errCh
+	<-errCh
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
 }
@@ -0,0 +1,809 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/charmbracelet/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForward(t *testing.T) {
+	t.Run("Client closes", func(t *testing.T) {
+		client, clientEnd := net.Pipe()
+		tun, relay := net.Pipe()
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- forward(context.Background(), clientEnd, tun)
+		}()
+
+		go client.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		_, err := io.ReadFull(relay, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(buf))
+
+		go relay.Write([]byte("pong"))
+		_, err = io.ReadFull(client, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "pong", string(buf))
+
+		client.Close()
+
+		select {
+		case err := <-errCh:
+			assert.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("forward didn't return")
+		}
+
+		// the tunnel is torn down too
+		_, err = relay.Read(buf)
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("Tunnel closes", func(t *testing.T) {
+		goroutines := runtime.NumGoroutine()
+
+		client, clientEnd := net.Pipe()
+		tun, relay := net.Pipe()
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- forward(context.Background(), clientEnd, tun)
+		}()
+
+		relay.Close()
+
+		select {
+		case err := <-errCh:
+			assert.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("forward didn't return")
+		}
+
+		_, err := client.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+		client.Close()
+
+		// both copy goroutines have exited
+		for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > goroutines && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+		assert.LessOrEqual(t, runtime.NumGoroutine(), goroutines)
+	})
+
+	t.Run("Context canceled", func(t *testing.T) {
+		client, clientEnd := net.Pipe()
+		tun, relay := net.Pipe()
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- forward(ctx, clientEnd, tun)
+		}()
+
+		cancel()
+
+		select {
+		case err := <-errCh:
+			assert.ErrorIs(t, err, context.Canceled)
+		case <-time.After(time.Second):
+			t.Fatal("forward didn't return")
+		}
+
+		_, err := client.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+		_, err = relay.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
+
+func TestDialForward(t *testing.T) {
+	t.Run("Dialed", func(t *testing.T) {
+		client, clientEnd := net.Pipe()
+		tun, relay := net.Pipe()
+
+		dial := func(ctx context.Context, opts ...iap.DialOption) (tunnel, error) {
+			return &fakeTunnel{Conn: tun}, nil
+		}
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- dialForward(context.Background(), dial, clientEnd)
+		}()
+
+		go client.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		_, err := io.ReadFull(relay, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(buf))
+
+		relay.Close()
+
+		select {
+		case err := <-errCh:
+			assert.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("dialForward didn't return")
+		}
+
+		_, err = client.Read(buf)
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("Dial fails", func(t *testing.T) {
+		client, clientEnd := net.Pipe()
+
+		refused := errors.New("connection refused")
+		dial := func(ctx context.Context, opts ...iap.DialOption) (tunnel, error) {
+			return nil, refused
+		}
+
+		err := dialForward(context.Background(), dial, clientEnd)
+		assert.ErrorIs(t, err, refused)
+
+		// the client is closed anyway
+		_, err = client.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
+
+func TestForwardHalfClose(t *testing.T) {
+	// tcpPair returns both ends of a loopback TCP connection, so the client can half-close
+	tcpPair := func(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer listener.Close()
+
+		dialed, err := net.Dial("tcp", listener.Addr().String())
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		accepted, err := listener.Accept()
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return dialed.(*net.TCPConn), accepted.(*net.TCPConn)
+	}
+
+	client, clientEnd := tcpPair(t)
+	tun, relay := tcpPair(t)
+	defer client.Close()
+	defer relay.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- forward(context.Background(), clientEnd, tun)
+	}()
+
+	client.Write([]byte("request"))
+	assert.NoError(t, client.CloseWrite())
+
+	// the tunnel can't be half-closed in general, so the relay sees the whole
+	// request and then the tunnel closing
+	buf, err := io.ReadAll(relay)
+	assert.NoError(t, err)
+	assert.Equal(t, "request", string(buf))
+
+	// the error depends on which direction noticed first, so only check it returns
+	select {
+	case <-errCh:
+	case <-time.After(time.Second):
+		t.Fatal("forward didn't return")
+	}
+
+	// and the client is disconnected rather than left waiting for a response
+	_, err = client.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestHandleClient(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	client, clientEnd := net.Pipe()
+	dial := func(ctx context.Context, opts ...iap.DialOption) (tunnel, error) {
+		tun, relay := net.Pipe()
+		relay.Close()
+		return &fakeTunnel{Conn: tun}, nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		handleClient(context.Background(), dial, clientEnd)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("handleClient didn't return")
+	}
+	client.Close()
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[0], "Client connected")
+	assert.Contains(t, lines[1], "Client disconnected")
+
+	// both lines carry the same ID
+	id := regexp.MustCompile(`id=(\w+)`)
+	match := id.FindStringSubmatch(lines[0])
+	if assert.NotNil(t, match) {
+		assert.Contains(t, lines[1], match[0])
+	}
+}
+
+func TestToggleDebug(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	SetLogLevel(log.InfoLevel)
+	defer SetLogLevel(log.InfoLevel)
+
+	runForward := func() {
+		client, clientEnd := net.Pipe()
+		defer client.Close()
+		tun, relay := net.Pipe()
+		relay.Close()
+
+		forward(context.Background(), clientEnd, tun)
+	}
+
+	runForward()
+	assert.NotContains(t, logs.String(), "Stopped copying")
+
+	assert.Equal(t, log.DebugLevel, ToggleDebug())
+	runForward()
+	assert.Contains(t, logs.String(), "Stopped copying")
+
+	assert.Equal(t, log.InfoLevel, ToggleDebug())
+	logs.Reset()
+	runForward()
+	assert.NotContains(t, logs.String(), "Stopped copying")
+}
+
+func TestDialTimeout(t *testing.T) {
+	// slowDial ignores ctx and only returns once released
+	slowDial := func(release chan struct{}, tun *fakeTunnel) dialFunc {
+		return func(ctx context.Context, opts ...iap.DialOption) (tunnel, error) {
+			<-release
+			return tun, nil
+		}
+	}
+
+	t.Run("Context canceled", func(t *testing.T) {
+		release := make(chan struct{})
+		defer close(release)
+
+		conn, _ := net.Pipe()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		dial := withDialTimeout(slowDial(release, &fakeTunnel{Conn: conn}), time.Hour)
+
+		time.AfterFunc(10*time.Millisecond, cancel)
+
+		start := time.Now()
+		_, err := dial(ctx)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		release := make(chan struct{})
+
+		conn, relay := net.Pipe()
+		defer relay.Close()
+
+		dial := withDialTimeout(slowDial(release, &fakeTunnel{Conn: conn}), 10*time.Millisecond)
+
+		_, err := dial(context.Background())
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		// the tunnel is closed once the abandoned dial finishes
+		close(release)
+		_, err = relay.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
+
+func TestDestinationPolicy(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	policy := func(zone, instance, host, port string) error {
+		if instance == "allowed" && port == "22" {
+			return nil
+		}
+		return errors.New("not allowed")
+	}
+
+	var dialed int
+	dial := func(ctx context.Context, opts ...iap.DialOption) (tunnel, error) {
+		dialed++
+		tun, relay := net.Pipe()
+		relay.Close()
+		return &fakeTunnel{Conn: tun}, nil
+	}
+
+	t.Run("Allowed", func(t *testing.T) {
+		dialed = 0
+		dial := withDestinationPolicy(dial, []iap.DialOption{iap.WithInstance("allowed", "zone", "nic0"), iap.WithPort("22")}, policy)
+
+		tun, err := dial(context.Background())
+		assert.NoError(t, err)
+		assert.NotNil(t, tun)
+		assert.Equal(t, 1, dialed)
+	})
+
+	t.Run("Denied", func(t *testing.T) {
+		dialed = 0
+		dial := withDestinationPolicy(dial, []iap.DialOption{iap.WithInstance("allowed", "zone", "nic0"), iap.WithPort("22")}, policy)
+
+		// options passed to the dial override the proxy's
+		_, err := dial(context.Background(), iap.WithPort("3389"))
+		assert.ErrorIs(t, err, errDenied)
+		assert.Equal(t, 0, dialed)
+
+		client, clientEnd := net.Pipe()
+		defer client.Close()
+		handleClient(context.Background(), withDestinationPolicy(dial, []iap.DialOption{iap.WithHost("10.0.0.1", "region", "network", "group")}, policy), clientEnd)
+
+		assert.Equal(t, 0, dialed)
+		assert.Contains(t, logs.String(), "Destination denied")
+
+		_, err = client.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
+
+func TestAllowDestinations(t *testing.T) {
+	policy, err := AllowDestinations([]string{"europe-west1-b/db-*:5432", "us-central1-a/bastion", "*.internal.example.com:22", "[fd00::1]:443"})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name                       string
+		zone, instance, host, port string
+		ok                         bool
+	}{
+		{"Instance", "europe-west1-b", "db-1", "", "5432", true},
+		{"Instance on another port", "europe-west1-b", "db-1", "", "22", false},
+		{"Instance in another zone", "europe-west1-c", "db-1", "", "5432", false},
+		{"Instance on any port", "us-central1-a", "bastion", "", "3389", true},
+		{"Host", "", "", "db.internal.example.com", "22", true},
+		{"Host on another port", "", "", "db.internal.example.com", "5432", false},
+		{"IPv6 host", "", "", "fd00::1", "443", true},
+		{"Other host", "", "", "10.0.0.1", "22", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := policy(test.zone, test.instance, test.host, test.port)
+			if test.ok {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+
+	_, err = AllowDestinations([]string{"zone/[db"})
+	assert.Error(t, err)
+}
+
+func TestClientAuthenticator(t *testing.T) {
+	var dialed atomic.Int32
+	dial := func(ctx context.Context, opts ...iap.DialOption) (tunnel, error) {
+		dialed.Add(1)
+		tun, relay := net.Pipe()
+		go io.Copy(relay, relay)
+		return &fakeTunnel{Conn: tun}, nil
+	}
+
+	// clients have to send the secret before anything else
+	auth := func(conn net.Conn) error {
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+		secret := make([]byte, 6)
+		if _, err := io.ReadFull(conn, secret); err != nil {
+			return err
+		}
+		if string(secret) != "secret" {
+			return errors.New("wrong secret")
+		}
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	go serve(listener, auth, func(conn net.Conn) {
+		handleClient(context.Background(), dial, conn)
+	})
+
+	t.Run("Refused", func(t *testing.T) {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		assert.NoError(t, err)
+		defer client.Close()
+
+		client.Write([]byte("wrong!"))
+
+		_, err = client.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+		assert.Zero(t, dialed.Load())
+	})
+
+	t.Run("Allowed", func(t *testing.T) {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		assert.NoError(t, err)
+		defer client.Close()
+
+		client.Write([]byte("secret"))
+
+		// the deadline set while checking the secret is cleared
+		time.Sleep(100 * time.Millisecond)
+		client.Write([]byte("hello"))
+
+		// the secret isn't forwarded
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(client, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(buf))
+		assert.EqualValues(t, 1, dialed.Load())
+	})
+}
+
+func TestPeerCredentials(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+
+	listener, err := net.Listen("unix", t.TempDir()+"/proxy.sock")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	client, err := net.Dial("unix", listener.Addr().String())
+	assert.NoError(t, err)
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	creds, err := PeerCredentials(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, Credentials{os.Getpid(), os.Getuid(), os.Getgid()}, creds)
+
+	tun, _ := net.Pipe()
+	_, err = PeerCredentials(tun)
+	assert.ErrorIs(t, err, errNotUnixSocket)
+}
+
+func TestAllowUIDs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+
+	listener, err := listenClients("unix:" + t.TempDir() + "/proxy.sock")
+	assert.NoError(t, err)
+	defer listener.Close()
+	assert.Equal(t, "unix", listener.Addr().Network())
+
+	client, err := net.Dial("unix", listener.Addr().String())
+	assert.NoError(t, err)
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	assert.NoError(t, AllowUIDs([]int{os.Getuid()})(conn))
+	assert.Error(t, AllowUIDs([]int{os.Getuid() + 1})(conn))
+
+	// TCP clients can't be identified
+	tun, _ := net.Pipe()
+	assert.ErrorIs(t, AllowUIDs([]int{os.Getuid()})(tun), errNotUnixSocket)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var (
+		dials int
+		fail  = true
+	)
+	dial := func(ctx context.Context, opts ...iap.DialOption) (tunnel, error) {
+		dials++
+		if fail {
+			return nil, errors.New("relay unreachable")
+		}
+		conn, _ := net.Pipe()
+		return &fakeTunnel{Conn: conn}, nil
+	}
+
+	now := time.Now()
+	b := newBreaker(dial, 3, time.Minute)
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		_, err := b.get(context.Background())
+		assert.NotErrorIs(t, err, errBreakerOpen)
+	}
+	assert.Equal(t, 3, dials)
+
+	// open, clients are rejected without dialing
+	_, err := b.get(context.Background())
+	assert.ErrorIs(t, err, errBreakerOpen)
+	assert.Equal(t, 3, dials)
+
+	// still open just before the cooldown is over
+	now = now.Add(time.Minute - time.Second)
+	_, err = b.get(context.Background())
+	assert.ErrorIs(t, err, errBreakerOpen)
+	assert.Equal(t, 3, dials)
+
+	// after the cooldown a failed dial reopens it straight away
+	now = now.Add(time.Second)
+	_, err = b.get(context.Background())
+	assert.NotErrorIs(t, err, errBreakerOpen)
+	_, err = b.get(context.Background())
+	assert.ErrorIs(t, err, errBreakerOpen)
+	assert.Equal(t, 4, dials)
+
+	// and a successful one resets it
+	now = now.Add(time.Minute)
+	fail = false
+	tun, err := b.get(context.Background())
+	assert.NoError(t, err)
+	tun.Close()
+
+	fail = true
+	_, err = b.get(context.Background())
+	assert.NotErrorIs(t, err, errBreakerOpen)
+	_, err = b.get(context.Background())
+	assert.NotErrorIs(t, err, errBreakerOpen)
+	assert.Equal(t, 7, dials)
+}
+
+func TestSNI(t *testing.T) {
+	route := func(serverName string) ([]iap.DialOption, error) {
+		if serverName == "db.internal" {
+			return []iap.DialOption{iap.WithInstance("db-1", "zone", "nic0"), iap.WithPort("5432")}, nil
+		}
+		return nil, errors.New("no route")
+	}
+
+	// hello starts a TLS handshake for serverName on a new conn, returning the
+	// other end
+	hello := func(serverName string) net.Conn {
+		client, clientEnd := net.Pipe()
+		go func() {
+			tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+			client.Close()
+		}()
+		return clientEnd
+	}
+
+	t.Run("Routed", func(t *testing.T) {
+		relays := make(chan net.Conn, 1)
+		var instance, port string
+		dial := func(ctx context.Context, opts ...iap.DialOption) (tunnel, error) {
+			_, instance, _, port = iap.Destination(opts...)
+			tun, relay := net.Pipe()
+			relays <- relay
+			return &fakeTunnel{Conn: tun}, nil
+		}
+
+		go handleSNIClient(context.Background(), dial, route, hello("db.internal"))
+
+		relay := <-relays
+		defer relay.Close()
+		assert.Equal(t, "db-1", instance)
+		assert.Equal(t, "5432", port)
+
+		// the destination gets the whole ClientHello
+		serverName, _, err := peekServerName(relay)
+		assert.NoError(t, err)
+		assert.Equal(t, "db.internal", serverName)
+	})
+
+	t.Run("No route", func(t *testing.T) {
+		var dialed bool
+		dial := func(ctx context.Context, opts ...iap.DialOption) (tunnel, error) {
+			dialed = true
+			return nil, errors.New("unreachable")
+		}
+
+		handleSNIClient(context.Background(), dial, route, hello("other.internal"))
+		assert.False(t, dialed)
+	})
+
+	t.Run("Not TLS", func(t *testing.T) {
+		client, clientEnd := net.Pipe()
+		defer client.Close()
+		go client.Write([]byte("SSH-2.0-OpenSSH_9.6\r\n"))
+
+		_, _, err := peekServerName(clientEnd)
+		assert.Error(t, err)
+	})
+}
+
+type fakeTunnel struct {
+	net.Conn
+	err  error
+	id   string
+	done chan struct{}
+}
+
+func (t *fakeTunnel) Err() error            { return t.err }
+func (t *fakeTunnel) Sent() uint64          { return 0 }
+func (t *fakeTunnel) Received() uint64      { return 0 }
+func (t *fakeTunnel) CorrelationID() string { return t.id }
+func (t *fakeTunnel) Done() <-chan struct{} { return t.done }
+
+func TestPool(t *testing.T) {
+	t.Run("Warm tunnel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		dials := make(chan tunnel, 2)
+		dial := func(ctx context.Context, opts ...iap.DialOption) (tunnel, error) {
+			conn, _ := net.Pipe()
+			tun := &fakeTunnel{Conn: conn}
+			dials <- tun
+			return tun, nil
+		}
+
+		p := newPool(ctx, 1, dial)
+
+		// the pool dials ahead of the first client
+		assert.Eventually(t, func() bool {
+			return len(p.slots[0].conn) == 1
+		}, time.Second, time.Millisecond)
+
+		tun, err := p.get(ctx)
+		assert.NoError(t, err)
+		assert.Same(t, <-dials, tun)
+
+		// and dials a replacement once it's taken
+		assert.Eventually(t, func() bool {
+			return len(p.slots[0].conn) == 1
+		}, time.Second, time.Millisecond)
+		assert.Len(t, dials, 1)
+	})
+
+	t.Run("Correlation ID", func(t *testing.T) {
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		defer log.SetOutput(os.Stderr)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		dial := func(ctx context.Context, opts ...iap.DialOption) (tunnel, error) {
+			conn, relay := net.Pipe()
+			go io.Copy(io.Discard, relay)
+			return iap.NewConn(conn, opts...), nil
+		}
+
+		p := newPool(ctx, 1, dial)
+
+		assert.Eventually(t, func() bool {
+			return len(p.slots[0].conn) == 1
+		}, time.Second, time.Millisecond)
+
+		// the warm tunnel has an ID of its own, which is logged with the client's
+		client, clientEnd := net.Pipe()
+		client.Close()
+		handleClient(ctx, p.get, clientEnd)
+
+		disconnected := regexp.MustCompile(`Client disconnected.* id=(\w+).* tunnel=(\w+)`).FindStringSubmatch(logs.String())
+		if assert.NotNil(t, disconnected) {
+			assert.NotEqual(t, disconnected[1], disconnected[2])
+		}
+	})
+
+	t.Run("Stale tunnel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		warm, relay := net.Pipe()
+		stale := &fakeTunnel{Conn: warm, err: errors.New("closed by relay")}
+
+		tunnels := make(chan tunnel, 3)
+		tunnels <- stale
+		for i := 0; i < 2; i++ {
+			fresh, _ := net.Pipe()
+			tunnels <- &fakeTunnel{Conn: fresh}
+		}
+
+		dial := func(ctx context.Context, opts ...iap.DialOption) (tunnel, error) {
+			select {
+			case tun := <-tunnels:
+				return tun, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		p := newPool(ctx, 1, dial)
+
+		// wait for the stale tunnel to be waiting in the pool
+		assert.Eventually(t, func() bool {
+			return len(p.slots[0].conn) == 1
+		}, time.Second, time.Millisecond)
+
+		tun, err := p.get(ctx)
+		assert.NoError(t, err)
+		assert.NotSame(t, stale, tun)
+		assert.NoError(t, tun.Err())
+
+		// the stale tunnel was closed
+		_, err = relay.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("Closed while waiting", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		warm, relay := net.Pipe()
+		closing := &fakeTunnel{Conn: warm, done: make(chan struct{})}
+		fresh, _ := net.Pipe()
+		replacement := &fakeTunnel{Conn: fresh}
+
+		tunnels := make(chan tunnel, 2)
+		tunnels <- closing
+		tunnels <- replacement
+
+		dial := func(ctx context.Context, opts ...iap.DialOption) (tunnel, error) {
+			select {
+			case tun := <-tunnels:
+				return tun, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		p := newPool(ctx, 1, dial)
+
+		assert.Eventually(t, func() bool {
+			return len(p.slots[0].conn) == 1
+		}, time.Second, time.Millisecond)
+
+		// the pool notices the tunnel close without a client taking it
+		closing.err = errors.New("closed by relay")
+		close(closing.done)
+
+		_, err := relay.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+
+		// and the replacement is ready for the next client
+		assert.Eventually(t, func() bool {
+			return len(tunnels) == 0 && len(p.slots[0].conn) == 1
+		}, time.Second, time.Millisecond)
+
+		tun, err := p.get(ctx)
+		assert.NoError(t, err)
+		assert.Same(t, replacement, tun)
+	})
+}
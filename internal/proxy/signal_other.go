@@ -0,0 +1,8 @@
+//go:build !unix
+
+package proxy
+
+import "context"
+
+// toggleDebugOnSignal does nothing as there is no SIGUSR1 on this platform.
+func toggleDebugOnSignal(ctx context.Context) {}
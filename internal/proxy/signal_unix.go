@@ -0,0 +1,29 @@
+//go:build unix
+
+package proxy
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/charmbracelet/log"
+)
+
+// toggleDebugOnSignal toggles debug logging whenever the process receives SIGUSR1,
+// until ctx is done.
+func toggleDebugOnSignal(ctx context.Context) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR1)
+	defer signal.Stop(sigCh)
+
+	for {
+		select {
+		case <-sigCh:
+			log.Info("Log level changed", "level", ToggleDebug())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/charmbracelet/log"
+)
+
+// clientHelloTimeout limits how long a client has to send its ClientHello.
+const clientHelloTimeout = 10 * time.Second
+
+// SNIRoute returns the options for the destination of clients asking for serverName
+// in their TLS ClientHello, or an error to refuse them.
+type SNIRoute func(serverName string) ([]iap.DialOption, error)
+
+// ListenSNI starts a proxy server that routes TLS clients to a destination by the
+// server name they ask for. The TLS connection isn't terminated: the ClientHello is
+// only read to pick the destination, then passed on with the rest of the connection.
+// The options returned by route are applied after opts. WithWarmPool is ignored, as
+// the destination isn't known until a client connects. Like Listen, it listens on a
+// Unix socket if listen is unix:PATH.
+func ListenSNI(ctx context.Context, listen string, opts []iap.DialOption, route SNIRoute, proxyOpts ...Option) {
+	var o options
+	for _, opt := range proxyOpts {
+		opt(&o)
+	}
+	o.warmPool = 0
+
+	listener, err := listenClients(listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Info("Listening", "addr", listener.Addr())
+
+	go toggleDebugOnSignal(ctx)
+
+	dial := newDialFunc(ctx, opts, o)
+
+	serve(listener, o.authenticator, func(conn net.Conn) {
+		handleSNIClient(ctx, dial, route, conn)
+	})
+}
+
+func handleSNIClient(ctx context.Context, dial dialFunc, route SNIRoute, conn net.Conn) {
+	serverName, client, err := peekServerName(conn)
+	if err != nil {
+		log.Error("Error reading ClientHello", "client", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+
+	opts, err := route(serverName)
+	if err != nil {
+		log.Warn("No route for server name", "client", conn.RemoteAddr(), "sni", serverName, "err", err)
+		conn.Close()
+		return
+	}
+
+	log.Debug("Routing client", "client", conn.RemoteAddr(), "sni", serverName)
+
+	handleClient(ctx, func(ctx context.Context, more ...iap.DialOption) (tunnel, error) {
+		return dial(ctx, append(opts[:len(opts):len(opts)], more...)...)
+	}, client)
+}
+
+var errClientHelloRead = errors.New("ClientHello read")
+
+// peekServerName reads the TLS ClientHello from conn and returns the server name it
+// asks for, which is empty if it doesn't ask for one. The returned conn reads the
+// ClientHello again before the rest of conn. The handshake is started with
+// crypto/tls, which stops once it has parsed the ClientHello, so nothing is written
+// to conn.
+func peekServerName(conn net.Conn) (string, net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var (
+		buf        bytes.Buffer
+		serverName string
+		read       bool
+	)
+
+	err := tls.Server(readOnlyConn{conn, io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName, read = hello.ServerName, true
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if !read {
+		return "", nil, err
+	}
+
+	return serverName, &replayConn{conn, io.MultiReader(&buf, conn)}, nil
+}
+
+// readOnlyConn reads from r and fails writes, so a TLS handshake can parse a
+// ClientHello without answering it.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// replayConn is a conn whose reads start with data already read from it.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) { return c.r.Read(b) }
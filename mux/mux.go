@@ -0,0 +1,61 @@
+// Package mux runs multiple streams over a single IAP tunnel.
+//
+// The tunnel carries a yamux session, so the process listening on the destination
+// port must speak yamux too, for example by calling Server on accepted connections.
+package mux
+
+import (
+	"io"
+	"net"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Session multiplexes streams over a single connection.
+type Session struct {
+	session *yamux.Session
+}
+
+func config() *yamux.Config {
+	config := yamux.DefaultConfig()
+	config.LogOutput = io.Discard
+	return config
+}
+
+// Client starts the client side of a session over conn, typically an *iap.Conn.
+func Client(conn net.Conn) (*Session, error) {
+	session, err := yamux.Client(conn, config())
+	if err != nil {
+		return nil, err
+	}
+	return &Session{session}, nil
+}
+
+// Server starts the server side of a session over conn.
+func Server(conn net.Conn) (*Session, error) {
+	session, err := yamux.Server(conn, config())
+	if err != nil {
+		return nil, err
+	}
+	return &Session{session}, nil
+}
+
+// OpenStream opens a new stream to the other side of the session.
+func (s *Session) OpenStream() (net.Conn, error) {
+	return s.session.OpenStream()
+}
+
+// AcceptStream waits for the other side of the session to open a stream.
+func (s *Session) AcceptStream() (net.Conn, error) {
+	return s.session.AcceptStream()
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	return s.session.NumStreams()
+}
+
+// Close closes the session, its streams and the underlying connection.
+func (s *Session) Close() error {
+	return s.session.Close()
+}
@@ -0,0 +1,142 @@
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession(t *testing.T) {
+	t.Run("Pipe", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		testSession(t, clientConn, serverConn)
+	})
+
+	t.Run("IAP", func(t *testing.T) {
+		r, w := net.Pipe()
+		clientConn := iap.NewConn(r)
+		testSession(t, clientConn, fakeRelay(t, w))
+	})
+}
+
+func testSession(t *testing.T, clientConn, serverConn net.Conn) {
+	client, err := Client(clientConn)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	server, err := Server(serverConn)
+	assert.NoError(t, err)
+	defer server.Close()
+
+	// echo every stream back to the client
+	go func() {
+		for {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				io.Copy(stream, stream)
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			stream, err := client.OpenStream()
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer stream.Close()
+
+			data := []byte(fmt.Sprintf("stream %v", i))
+			_, err = stream.Write(data)
+			assert.NoError(t, err)
+
+			buf := make([]byte, len(data))
+			_, err = io.ReadFull(stream, buf)
+			assert.NoError(t, err)
+			assert.Equal(t, data, buf)
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+// fakeRelay speaks the relay's side of the IAP protocol on relay, returning the
+// destination's end of the tunnel.
+func fakeRelay(t *testing.T, relay net.Conn) net.Conn {
+	dest, tunnel := net.Pipe()
+
+	writeFrame := func(tag uint16, data []byte) error {
+		header := make([]byte, 6)
+		binary.BigEndian.PutUint16(header, tag)
+		binary.BigEndian.PutUint32(header[2:], uint32(len(data)))
+		_, err := relay.Write(append(header, data...))
+		return err
+	}
+
+	// the success frame carries the session ID
+	go func() {
+		if err := writeFrame(0x1, []byte("session")); err != nil {
+			return
+		}
+
+		buf := make([]byte, iap.MaxFrameSize)
+		for {
+			n, err := tunnel.Read(buf)
+			if err != nil {
+				relay.Close()
+				return
+			}
+			if err := writeFrame(0x4, buf[:n]); err != nil {
+				tunnel.Close()
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer tunnel.Close()
+
+		header := make([]byte, 2)
+		for {
+			if _, err := io.ReadFull(relay, header); err != nil {
+				return
+			}
+
+			switch binary.BigEndian.Uint16(header) {
+			case 0x4:
+				length := make([]byte, 4)
+				if _, err := io.ReadFull(relay, length); err != nil {
+					return
+				}
+				if _, err := io.CopyN(tunnel, relay, int64(binary.BigEndian.Uint32(length))); err != nil {
+					return
+				}
+			case 0x7:
+				if _, err := io.CopyN(io.Discard, relay, 8); err != nil {
+					return
+				}
+			default:
+				t.Errorf("unexpected frame tag %#x", binary.BigEndian.Uint16(header))
+				return
+			}
+		}
+	}()
+
+	return dest
+}